@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+)
+
+//the commands of the admin listener, see: WithAdminAddr
+const debugCommand = "DEBUG"
+
+//AdminAddr returns the address of the admin listener, or nil until Run listens on it (see: WithAdminAddr)
+func (s *Server) AdminAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.adminAddr
+}
+
+//listenAdmin listens on the admin address, if there is one
+func (s *Server) listenAdmin() (net.Listener, error) {
+	if s.admin == "" {
+		return nil, nil
+	}
+	l, err := net.Listen("tcp", s.admin)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.adminAddr = l.Addr()
+	s.mu.Unlock()
+	return l, nil
+}
+
+//serveAdmin answers the admin commands on l until it's closed.
+//Admin connections don't hold the shutdown back, they're closed together with l
+func (s *Server) serveAdmin(l net.Listener) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			stop := context.AfterFunc(ctx, func() {
+				conn.Close()
+			})
+			defer stop()
+			s.handleAdmin(conn)
+		}()
+	}
+}
+
+//handleAdmin answers the commands of a single admin connection, one per line
+func (s *Server) handleAdmin(conn net.Conn) {
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		var resp []byte
+		switch cmd := string(bytes.TrimSpace(sc.Bytes())); cmd {
+		case debugCommand:
+			resp = s.debugDump()
+		default:
+			resp = fmt.Appendf(nil, "unknown command %q\n", cmd)
+		}
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+//debugDump lists the server's state, a "name value" line each, followed by an empty line
+func (s *Server) debugDump() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "connections %d\n", s.ActiveConnections())
+	fmt.Fprintf(&b, "persisted %d\n", s.persisted.Load())
+	fmt.Fprintf(&b, "persisted_bytes %d\n", s.PersistedBytes())
+	fmt.Fprintf(&b, "echoed_bytes %d\n", s.EchoedBytes())
+	fmt.Fprintf(&b, "dropped %d\n", s.DroppedMessages())
+	fmt.Fprintf(&b, "interrupted %d\n", s.dropped.Load())
+	fmt.Fprintf(&b, "deduped %d\n", s.DedupedMessages())
+	fmt.Fprintf(&b, "goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(&b, "shutting_down %t\n", s.closing.Load())
+	b.WriteString("\n")
+	return b.Bytes()
+}
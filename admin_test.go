@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//This test shows the admin listener answers DEBUG with the state of the server
+func TestAdminDebug(t *testing.T) {
+	s := NewServer(WithAddr(addr), WithAdminAddr(addr), WithPersister(&recordingPersister{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Run(ctx)
+	}()
+	<-s.Ready()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, message)
+	mustReadLine(t, bufio.NewReader(conn))
+
+	admin, err := net.Dial("tcp", s.AdminAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	r := bufio.NewReader(admin)
+	fmt.Fprintln(admin, "DEBUG")
+	dump := map[string]string{}
+	for {
+		line := strings.TrimSpace(mustReadLine(t, r))
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, " ")
+		dump[name] = value
+	}
+	for name, want := range map[string]string{"connections": "1", "persisted": "1", "dropped": "0", "shutting_down": "false"} {
+		if dump[name] != want {
+			t.Fatalf("Expected %s %s but received %q in %v", name, want, dump[name], dump)
+		}
+	}
+	if n, err := strconv.Atoi(dump["goroutines"]); err != nil || n <= 0 {
+		t.Fatalf("Expected a number of goroutines but received %q", dump["goroutines"])
+	}
+	fmt.Fprintln(admin, "HELP")
+	if resp := mustReadLine(t, r); !strings.HasPrefix(resp, "unknown command") {
+		t.Fatalf("Expected an unknown command but received %q", resp)
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatalf("Expected a clean termination but received '%v'", err)
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatal("Expected the admin connection to be closed")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+//ErrQueueFull closes a connection whose message didn't fit in mCh, see: Disconnect
+var ErrQueueFull = errors.New("message queue full")
+
+//Strategy decides what happens to a message when mCh is full,
+//because the consumers can't keep up with the clients, see: WithBackpressure.
+//Send is called concurrently by all the connection handlers.
+//It reports whether a message was dropped, and an error closes the connection
+type Strategy interface {
+	Send(ctx context.Context, mCh chan []byte, msg []byte) (dropped bool, err error)
+}
+
+//Block waits for room in mCh, slowing down the client (the default)
+type Block struct{}
+
+func (Block) Send(ctx context.Context, mCh chan []byte, msg []byte) (bool, error) {
+	return false, ChannelPersister(mCh).Persist(ctx, msg)
+}
+
+//DropNewest drops the message that doesn't fit.
+//Without a buffer (see: WithMessageBufferSize) every message is dropped unless a consumer is already waiting for it
+type DropNewest struct{}
+
+func (DropNewest) Send(ctx context.Context, mCh chan []byte, msg []byte) (bool, error) {
+	select {
+	case mCh <- msg:
+		return false, nil
+	default:
+		return true, nil
+	}
+}
+
+//DropOldest makes room for the message by dropping the oldest message in mCh.
+//Without a buffer there's nothing to drop, it waits for a consumer like Block
+type DropOldest struct{}
+
+func (DropOldest) Send(ctx context.Context, mCh chan []byte, msg []byte) (bool, error) {
+	if cap(mCh) == 0 {
+		return false, ChannelPersister(mCh).Persist(ctx, msg)
+	}
+	dropped := false
+	for {
+		select {
+		case mCh <- msg:
+			return dropped, nil
+		case <-ctx.Done():
+			return dropped, ctx.Err()
+		default:
+		}
+		//the consumers or another handler may beat us to it, then we try again.
+		//Either there's room or there's a message to drop, this doesn't wait for long
+		select {
+		case <-mCh:
+			dropped = true
+		case mCh <- msg:
+			return dropped, nil
+		case <-ctx.Done():
+			return dropped, ctx.Err()
+		}
+	}
+}
+
+//Disconnect drops the message that doesn't fit and closes the connection with ErrQueueFull.
+//Like DropNewest, it needs a buffer unless a consumer is always waiting
+type Disconnect struct{}
+
+func (Disconnect) Send(ctx context.Context, mCh chan []byte, msg []byte) (bool, error) {
+	select {
+	case mCh <- msg:
+		return false, nil
+	default:
+		return true, ErrQueueFull
+	}
+}
+
+//strategyPersister persists messages to mCh with a Strategy and counts the dropped messages
+type strategyPersister struct {
+	mCh      chan []byte
+	strategy Strategy
+	dropped  *atomic.Uint64
+}
+
+//Persist is ChannelPersister's, but with the strategy deciding what to do when mCh is full
+func (p *strategyPersister) Persist(ctx context.Context, msg []byte) (err error) {
+	defer func() {
+		//sending on a closed channel is the only way to panic here
+		if recover() != nil {
+			err = ErrChannelClosed
+		}
+	}()
+	dropped, err := p.strategy.Send(ctx, p.mCh, msg)
+	if dropped {
+		p.dropped.Add(1)
+	}
+	return err
+}
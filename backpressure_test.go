@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"testing"
+	"time"
+)
+
+//This test shows what every strategy does when nobody drains mCh and its buffer is full.
+func TestBackpressure(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		strategy Strategy
+		queued   string //what's left in mCh after "1", "2" and "3"
+		dropped  uint64
+	}{
+		{"drop newest", DropNewest{}, "1", 2},
+		{"drop oldest", DropOldest{}, "3", 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cliConn, servConn := tcpPair(t)
+			s := NewServer(WithMessageBufferSize(1), WithBackpressure(tc.strategy))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go s.persistAndEcho(servConn, ctx)
+
+			r := bufio.NewReader(cliConn)
+			for _, msg := range []string{"1", "2", "3"} {
+				cliConn.Write([]byte(msg + "\n"))
+				//the handler keeps going although nothing is consumed
+				if echo := mustReadLine(t, r); echo != msg+"\n" {
+					t.Fatalf("Expected '%s' but received '%s'", msg, echo)
+				}
+			}
+			if dropped := s.DroppedMessages(); dropped != tc.dropped {
+				t.Fatalf("Expected %d dropped messages but received %d", tc.dropped, dropped)
+			}
+			if m := <-s.mCh; string(m) != tc.queued {
+				t.Fatalf("Expected '%s' to be queued but received '%s'", tc.queued, m)
+			}
+		})
+	}
+}
+
+//This test shows Block slows the client down until the consumer catches up.
+func TestBackpressureBlock(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	s := NewServer(WithMessageBufferSize(1), WithBackpressure(Block{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	r := bufio.NewReader(cliConn)
+	cliConn.Write([]byte("1\n2\n"))
+	mustReadLine(t, r)
+	//there's no room for "2"
+	cliConn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := r.ReadString('\n'); !isTimeout(err) {
+		t.Fatalf("Expected the handler to wait for the consumer but received '%v'", err)
+	}
+	<-s.mCh
+	cliConn.SetReadDeadline(time.Now().Add(time.Second))
+	if echo := mustReadLine(t, r); echo != "2\n" {
+		t.Fatalf("Expected '2' but received '%s'", echo)
+	}
+	if dropped := s.DroppedMessages(); dropped != 0 {
+		t.Fatalf("Expected no dropped messages but received %d", dropped)
+	}
+}
+
+//This test shows Disconnect closes the connection whose message doesn't fit.
+func TestBackpressureDisconnect(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	s := NewServer(WithMessageBufferSize(1), WithBackpressure(Disconnect{}))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.persistAndEcho(servConn, context.Background())
+	}()
+
+	r := bufio.NewReader(cliConn)
+	cliConn.Write([]byte("1\n2\n"))
+	mustReadLine(t, r)
+	if err := <-errCh; err != ErrQueueFull {
+		t.Fatalf("Expected '%v' but received '%v'", ErrQueueFull, err)
+	}
+	if dropped := s.DroppedMessages(); dropped != 1 {
+		t.Fatalf("Expected 1 dropped message but received %d", dropped)
+	}
+}
+
+//This test shows DropOldest waits for a consumer without a buffer, until it's cancelled.
+func TestBackpressureDropOldestUnbuffered(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	s := NewServer(WithBackpressure(DropOldest{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.persistAndEcho(servConn, ctx)
+	}()
+
+	r := bufio.NewReader(cliConn)
+	cliConn.Write([]byte("1\n2\n"))
+	if m := <-s.mCh; string(m) != "1" {
+		t.Fatalf("Expected '1' but received '%s'", m)
+	}
+	mustReadLine(t, r)
+	//nobody takes "2"
+	cliConn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := r.ReadString('\n'); !isTimeout(err) {
+		t.Fatalf("Expected the handler to wait for the consumer but received '%v'", err)
+	}
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Expected no error but received '%v'", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the handler to return once cancelled")
+	}
+	if dropped := s.DroppedMessages(); dropped != 0 {
+		t.Fatalf("Expected no dropped messages but received %d", dropped)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//Batcher persists several messages at once, e.g. in a single database transaction.
+//BatchPersister uses it when the Persister it wraps implements it
+type Batcher interface {
+	PersistBatch(ctx context.Context, msgs [][]byte) error
+}
+
+//BatchPersister is a Persister that accumulates the messages
+//and persists them in batches with the Persister it wraps.
+//A batch is persisted once it's full or once its first message waited for the flush interval.
+//Close persists what's left, the messages of a batch that isn't persisted yet are lost on a crash
+type BatchPersister struct {
+	next     Persister
+	size     int
+	interval time.Duration
+
+	mu    sync.Mutex
+	batch [][]byte
+	timer *time.Timer
+	err   error //the failure of a flush no Persist call waited for
+}
+
+//NewBatchPersister wraps next with batches of up to size messages (at least 1),
+//persisted at most interval after their first message (or only when they're full with 0)
+func NewBatchPersister(next Persister, size int, interval time.Duration) *BatchPersister {
+	return &BatchPersister{next: next, size: max(size, 1), interval: interval}
+}
+
+//Persist adds msg to the batch, persisting the batch if it's full.
+//It returns the error of persisting the batch, or of the last batch the flush interval persisted
+func (p *BatchPersister) Persist(ctx context.Context, msg []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.err; err != nil {
+		p.err = nil
+		return err
+	}
+	p.batch = append(p.batch, msg)
+	if len(p.batch) >= p.size {
+		return p.flush(ctx)
+	}
+	if len(p.batch) == 1 && p.interval > 0 {
+		p.timer = time.AfterFunc(p.interval, func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.err = p.flush(context.Background())
+		})
+	}
+	return nil
+}
+
+//Flush persists the batch right away
+func (p *BatchPersister) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.flush(ctx)
+}
+
+//Close persists what's left in the batch, e.g. once the server is done.
+//It doesn't close the Persister it wraps
+func (p *BatchPersister) Close() error {
+	err := p.Flush(context.Background())
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		err = p.err
+	}
+	p.err = nil
+	return err
+}
+
+//flush persists the batch, it's called with mu held
+func (p *BatchPersister) flush(ctx context.Context) error {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if len(p.batch) == 0 {
+		return nil
+	}
+	batch := p.batch
+	p.batch = nil
+	if b, ok := p.next.(Batcher); ok {
+		return b.PersistBatch(ctx, batch)
+	}
+	for _, msg := range batch {
+		if err := p.next.Persist(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
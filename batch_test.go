@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+//batchRecorder records the batches it persists
+type batchRecorder struct {
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (r *batchRecorder) Persist(ctx context.Context, msg []byte) error {
+	return r.PersistBatch(ctx, [][]byte{msg})
+}
+
+func (r *batchRecorder) PersistBatch(ctx context.Context, msgs [][]byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var batch []string
+	for _, msg := range msgs {
+		batch = append(batch, string(msg))
+	}
+	r.batches = append(r.batches, batch)
+	return nil
+}
+
+func (r *batchRecorder) recorded() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]string(nil), r.batches...)
+}
+
+//This test shows full batches are persisted right away and the rest on Close.
+func TestBatchPersister(t *testing.T) {
+	r := &batchRecorder{}
+	p := NewBatchPersister(r, 2, 0)
+	for _, msg := range []string{"1", "2", "3", "4", "5"} {
+		if err := p.Persist(context.Background(), []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if batches := r.recorded(); !reflect.DeepEqual(batches, [][]string{{"1", "2"}, {"3", "4"}}) {
+		t.Fatalf("Expected 2 full batches before Close but received %q", batches)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if batches := r.recorded(); !reflect.DeepEqual(batches, [][]string{{"1", "2"}, {"3", "4"}, {"5"}}) {
+		t.Fatalf("Expected the last batch on Close but received %q", batches)
+	}
+}
+
+//This test shows a batch that isn't full is persisted after the flush interval,
+//and a Persister that can't persist batches gets the messages one by one.
+func TestBatchPersisterInterval(t *testing.T) {
+	r := &recordingPersister{}
+	p := NewBatchPersister(r, 10, 50*time.Millisecond)
+	p.Persist(context.Background(), []byte("1"))
+	p.Persist(context.Background(), []byte("2"))
+	if msgs := r.messages(); len(msgs) != 0 {
+		t.Fatalf("Expected the batch to wait but received %q", msgs)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(r.messages()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if msgs := r.messages(); !reflect.DeepEqual(msgs, []string{"1", "2"}) {
+		t.Fatalf("Expected the batch after the interval but received %q", msgs)
+	}
+}
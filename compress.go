@@ -0,0 +1,79 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"net"
+)
+
+//Compression is how the messages and echoes of a connection are compressed, see: WithCompression
+type Compression int
+
+const (
+	//CompressionNone sends the messages and echoes as they are (the default)
+	CompressionNone Compression = iota
+	//CompressionGzip expects a gzip stream from the client and answers with one
+	CompressionGzip
+)
+
+//gzipConn decompresses what it reads and compresses what it writes.
+//Every write is flushed, so the client gets every echo as soon as it's written
+type gzipConn struct {
+	net.Conn
+	r *gzip.Reader //created on the first read, since it starts by reading the gzip header
+	w *gzip.Writer
+}
+
+func newGzipConn(conn net.Conn) *gzipConn {
+	return &gzipConn{Conn: conn, w: gzip.NewWriter(conn)}
+}
+
+func (c *gzipConn) Read(p []byte) (int, error) {
+	if c.r == nil {
+		r, err := gzip.NewReader(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		//the stream ends with the client's gzip stream, rather than waiting for another one
+		r.Multistream(false)
+		c.r = r
+	}
+	return c.r.Read(p)
+}
+
+func (c *gzipConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+//Close ends the gzip stream and closes the connection
+func (c *gzipConn) Close() error {
+	c.endStream()
+	return c.Conn.Close()
+}
+
+//endStream writes the end of the gzip stream, the connection stays open.
+//The stream ends just once
+func (c *gzipConn) endStream() error {
+	return c.w.Close()
+}
+
+//Unwrap returns the accepted connection, e.g. to get to the *net.TCPConn
+func (c *gzipConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+//compress wraps conn, handled with ctx, according to the server's compression, unless it's already wrapped.
+//WebSocket connections aren't compressed, see: WithWebSocket
+func (s *Server) compress(conn net.Conn, ctx context.Context) net.Conn {
+	if _, ok := conn.(*gzipConn); ok || s.compression != CompressionGzip {
+		return conn
+	}
+	if _, ok := s.framerOf(ctx).(webSocketFramer); ok {
+		return conn
+	}
+	return newGzipConn(conn)
+}
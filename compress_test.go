@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//This test shows a gzip client receives every echo compressed as soon as it's written
+//and the server persists the decompressed messages.
+func TestCompressionGzip(t *testing.T) {
+	p := &recordingPersister{}
+	addr, stop := StartTest(t, WithCompression(CompressionGzip), WithPersister(p))
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	zw := gzip.NewWriter(conn)
+	var zr *bufio.Reader
+	for i := 0; i < 2; i++ {
+		zw.Write([]byte(message + "\n"))
+		zw.Flush()
+		if zr == nil {
+			r, err := gzip.NewReader(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zr = bufio.NewReader(r)
+		}
+		if echo := mustReadLine(t, zr); echo != message+"\n" {
+			t.Fatalf("Expected '%s' but received '%s'", message, echo)
+		}
+	}
+	//ending the stream closes the connection cleanly, with the end of the echoes' stream
+	zw.Close()
+	if rest, err := io.ReadAll(zr); err != nil || len(rest) != 0 {
+		t.Fatalf("Expected the echoes to end cleanly but received '%s' (%v)", rest, err)
+	}
+
+	want := []string{message, message}
+	deadline := time.Now().Add(time.Second)
+	for !reflect.DeepEqual(p.messages(), want) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := p.messages(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v to be persisted but received %v", want, got)
+	}
+}
+
+//This test shows the connection is closed when the client doesn't send gzip.
+func TestCompressionGzipInvalid(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	s := NewServer(WithCompression(CompressionGzip), WithPersister(&recordingPersister{}))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.handler(servConn, context.Background())
+	}()
+	cliConn.Write([]byte("this is not gzip\n"))
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the handler to return")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//defaultBroadcastTimeout bounds broadcast writes when there is no write timeout (see: WithWriteTimeout)
+const defaultBroadcastTimeout = 5 * time.Second
+
+//connEntry is a connection handled by Serve
+type connEntry struct {
+	conn    net.Conn
+	id      uint64
+	remote  net.Addr
+	counted *countingConn //if the server counts bytes
+	since   time.Time
+	cancel  context.CancelFunc //interrupts the handler, see: CloseConnection
+	framer  Framer
+	//reason is the first CloseReason the connection got, see: setCloseReason
+	reason atomic.Int32
+
+	//writeMu keeps frames written by the handler and by Broadcast from interleaving
+	//it guards w, which buffers them so every frame is written at once
+	//flushing is set while a flush is scheduled, see: WithFlushInterval
+	//closed is set once the connection is closed, see: closeHandled
+	writeMu  sync.Mutex
+	w        *bufio.Writer
+	flushing bool
+	closed   bool
+}
+
+//register adds conn, handled with ctx, to the connections being handled
+func (s *Server) register(conn net.Conn, ctx context.Context, cancel context.CancelFunc) *connEntry {
+	id, _ := ConnID(ctx)
+	counted, _ := ctx.Value(bytesKey{}).(*countingConn)
+	c := &connEntry{conn: conn, id: id, remote: RemoteAddr(ctx), counted: counted, since: time.Now(), cancel: cancel, framer: s.framerOf(ctx), w: bufio.NewWriter(conn)}
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	s.conns[id] = c
+	return c
+}
+
+func (s *Server) unregister(id uint64) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	delete(s.conns, id)
+}
+
+//lookup returns the entry of conn, if it is handled by Serve with ctx
+func (s *Server) lookup(conn net.Conn, ctx context.Context) *connEntry {
+	id, ok := ConnID(ctx)
+	if !ok {
+		return nil
+	}
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if c := s.conns[id]; c != nil && c.conn == conn {
+		return c
+	}
+	return nil
+}
+
+//snapshot returns the connections being handled
+func (s *Server) snapshot() []*connEntry {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	conns := make([]*connEntry, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+//ConnInfo describes a connection being handled, see: Connections
+type ConnInfo struct {
+	ID         uint64
+	RemoteAddr net.Addr
+	//BytesRead and BytesWritten are only counted with WithByteCounters
+	BytesRead    int64
+	BytesWritten int64
+	//ConnectedAt is when the server started handling the connection
+	ConnectedAt time.Time
+	//CloseReason is why the connection is closed, once it's known
+	CloseReason CloseReason
+}
+
+//info describes c, see: ConnInfo
+func (c *connEntry) info() ConnInfo {
+	info := ConnInfo{ID: c.id, RemoteAddr: c.remote, ConnectedAt: c.since, CloseReason: CloseReason(c.reason.Load())}
+	if c.counted != nil {
+		info.BytesRead, info.BytesWritten = c.counted.read.Load(), c.counted.written.Load()
+	}
+	return info
+}
+
+//setCloseReason records why the connection handled with ctx is closed, unless it already has a reason,
+//e.g. CloseKicked when the handler is interrupted by CloseConnection. It returns the reason it has
+func (s *Server) setCloseReason(ctx context.Context, reason CloseReason) CloseReason {
+	id, ok := ConnID(ctx)
+	if !ok {
+		return reason
+	}
+	s.connsMu.Lock()
+	c := s.conns[id]
+	s.connsMu.Unlock()
+	if c == nil {
+		return reason
+	}
+	c.reason.CompareAndSwap(int32(CloseReasonUnknown), int32(reason))
+	return CloseReason(c.reason.Load())
+}
+
+//Connections returns the connections being handled, ordered by ID.
+//It is a copy, safe to keep while the connections come and go
+func (s *Server) Connections() []ConnInfo {
+	conns := s.snapshot()
+	infos := make([]ConnInfo, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, c.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+//CloseConnection closes the connection with the given ID (see: Connections), e.g. to kick a misbehaving client.
+//Its handler is interrupted just like when the server's context is cancelled.
+//It returns false if there's no such connection, e.g. because it was already closed
+func (s *Server) CloseConnection(id uint64) bool {
+	s.connsMu.Lock()
+	c := s.conns[id]
+	s.connsMu.Unlock()
+	if c == nil {
+		return false
+	}
+	s.logger.Info("Closing connection by ID", "conn", id)
+	c.reason.CompareAndSwap(int32(CloseReasonUnknown), int32(CloseKicked))
+	if c.cancel != nil {
+		c.cancel()
+	}
+	//the wrappers (e.g. compression) are closed by Serve once the handler returns, closing the connection they wrap
+	//unblocks the handler even while it's writing, and closing it twice is harmless
+	conn := unwrapConn(c.conn)
+	interruptRead(conn)
+	conn.Close()
+	return true
+}
+
+//closeAll closes all the connections being handled, see: CloseConnection
+func (s *Server) closeAll() {
+	for _, c := range s.snapshot() {
+		//it's the shutdown that kicks them
+		c.reason.CompareAndSwap(int32(CloseReasonUnknown), int32(CloseShutdown))
+		s.CloseConnection(c.id)
+	}
+}
+
+//unwrapConn returns the connection conn wraps (see: countingConn and gzipConn), or conn itself
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		u, ok := conn.(interface{ Unwrap() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = u.Unwrap()
+	}
+}
+
+//Broadcast writes msg as a frame to all the connections being handled
+//and returns the number of connections it was written to.
+//Connections that fail are skipped. A client that doesn't read can't block Broadcast
+//(or its own echoes) for longer than the write timeout (see: WithWriteTimeout),
+//or defaultBroadcastTimeout (5s) when there is none
+func (s *Server) Broadcast(msg []byte) int {
+	n := 0
+	for _, c := range s.snapshot() {
+		if err := s.broadcastTo(c, msg); err != nil {
+			s.logger.Warn("Broadcast failed", "conn", c.id, "err", err)
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+func (s *Server) broadcastTo(c *connEntry, msg []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if s.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	} else {
+		c.conn.SetWriteDeadline(time.Now().Add(defaultBroadcastTimeout))
+		//without a write timeout the echoes don't expect a deadline, clear it
+		defer clearWriteDeadline(c.conn)
+	}
+	//broadcasts aren't batched with the echoes, they're flushed right away
+	if err := c.framer.WriteFrame(c.w, msg); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+//bufferFrame writes msg as a frame to c's buffer and flushes it,
+//or schedules a flush if there's a flush interval (see: WithFlushInterval).
+//It's called with c.writeMu held
+func (s *Server) bufferFrame(c *connEntry, msg []byte) error {
+	if c.closed {
+		return net.ErrClosed
+	}
+	//frames larger than the buffer are written right away
+	if s.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+	if err := c.framer.WriteFrame(c.w, msg); err != nil {
+		return err
+	}
+	if s.flushInterval <= 0 {
+		return s.flush(c)
+	}
+	if !c.flushing {
+		c.flushing = true
+		time.AfterFunc(s.flushInterval, func() {
+			c.writeMu.Lock()
+			defer c.writeMu.Unlock()
+			c.flushing = false
+			if c.closed {
+				//closeHandled flushed already
+				return
+			}
+			//a failure sticks to c.w, so the next frame fails with it
+			s.flush(c)
+		})
+	}
+	return nil
+}
+
+//flush writes c's buffer to the connection, within the write timeout.
+//It's called with c.writeMu held
+func (s *Server) flush(c *connEntry) error {
+	if c.w.Buffered() == 0 {
+		return nil
+	}
+	if s.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+	return c.w.Flush()
+}
+
+//closeHandled flushes what's left in the buffer of conn and closes it, if it's handled by Serve with ctx.
+//The writes of Broadcast and of the flush interval that are in flight complete first,
+//the ones that come later fail with net.ErrClosed instead of truncating the echoes.
+//It closes conn just once, however many times it's called
+func (s *Server) closeHandled(conn net.Conn, ctx context.Context) {
+	c := s.lookup(conn, ctx)
+	if c == nil {
+		s.closeConn(conn)
+		return
+	}
+	c.writeMu.Lock()
+	if c.closed {
+		c.writeMu.Unlock()
+		return
+	}
+	s.flush(c)
+	c.closed = true
+	c.writeMu.Unlock()
+	//no more writes, closing may take a while (see: WithHalfCloseOnShutdown) and Broadcast mustn't wait for it
+	s.closeConn(conn)
+}
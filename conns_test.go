@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//This test shows a message broadcast by one connection's handler reaches all the clients.
+func TestBroadcast(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s *Server
+	handling := make(chan struct{})
+	types := make(chan net.Conn, 2)
+	broadcasts := make(chan int, 1)
+	s = NewServer(WithHandler(NoError(func(conn net.Conn, ctx context.Context) {
+		types <- conn
+		handling <- struct{}{}
+		sc := bufio.NewScanner(conn)
+		for sc.Scan() {
+			broadcasts <- s.Broadcast(sc.Bytes())
+		}
+	})))
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, ctx)
+		close(finished)
+	}()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-handling
+		conns = append(conns, conn)
+	}
+
+	//handlers get the accepted connection itself
+	if _, ok := (<-types).(*net.TCPConn); !ok {
+		t.Fatal("Expected the handler to receive a *net.TCPConn")
+	}
+
+	//only the first client sends
+	conns[0].Write([]byte(message + "\n"))
+	if n := <-broadcasts; n != 2 {
+		t.Fatalf("Expected the message to be broadcast to 2 clients but it was broadcast to %d", n)
+	}
+	for i, conn := range conns {
+		if line, err := bufio.NewReader(conn).ReadString('\n'); line != message+"\n" {
+			t.Fatalf("Expected client %d to receive '%s' but received '%s' (%v)", i, message, line, err)
+		}
+	}
+
+	//the handler only returns when its client goes away
+	for _, conn := range conns {
+		conn.Close()
+	}
+	l.Close()
+	cancel()
+	<-finished
+	if n := s.Broadcast([]byte(message)); n != 0 {
+		t.Fatalf("Expected no clients left but the message was broadcast to %d", n)
+	}
+}
+
+//This test shows a client that doesn't read can't block Broadcast forever.
+func TestBroadcastSlowReader(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handling := make(chan struct{})
+	s := NewServer(WithWriteTimeout(100*time.Millisecond), WithHandler(NoError(func(conn net.Conn, ctx context.Context) {
+		handling <- struct{}{}
+		<-ctx.Done()
+	})))
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, ctx)
+		close(finished)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-handling
+
+	//much more than the socket buffers can hold
+	if n := s.Broadcast(make([]byte, 64<<20)); n != 0 {
+		t.Fatalf("Expected the broadcast to time out but it was written to %d clients", n)
+	}
+	l.Close()
+	cancel()
+	<-finished
+}
+
+//This test shows Connections lists the connections being handled with their addresses and byte counts.
+func TestConnections(t *testing.T) {
+	s := NewServer(WithAddr(addr), WithPersister(&recordingPersister{}), WithByteCounters(true))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	<-s.Ready()
+	start := time.Now()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		//the echo shows the connection is being handled
+		conn.Write([]byte(message + "\n"))
+		mustReadLine(t, bufio.NewReader(conn))
+		conns = append(conns, conn)
+	}
+
+	infos := s.Connections()
+	if len(infos) != len(conns) {
+		t.Fatalf("Expected %d connections but received %v", len(conns), infos)
+	}
+	line := int64(len(message + "\n"))
+	for i, info := range infos {
+		if info.ID != uint64(i+1) || info.RemoteAddr.String() != conns[i].LocalAddr().String() {
+			t.Fatalf("Expected connection %d from %v but received %+v", i+1, conns[i].LocalAddr(), info)
+		}
+		if info.BytesRead != line || info.BytesWritten != line {
+			t.Fatalf("Expected %d bytes read and written but received %+v", line, info)
+		}
+		if info.ConnectedAt.Before(start) || info.ConnectedAt.After(time.Now()) {
+			t.Fatalf("Expected the connection to start during the test but received %v", info.ConnectedAt)
+		}
+	}
+
+	//closed connections are gone
+	conns[0].Close()
+	deadline := time.Now().Add(time.Second)
+	for len(s.Connections()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if infos := s.Connections(); len(infos) != 1 || infos[0].ID != 2 {
+		t.Fatalf("Expected only connection 2 but received %v", infos)
+	}
+}
+
+//This test shows closing a connection by ID interrupts its handler and disconnects the client,
+//even with the connection wrapped by the server.
+func TestCloseConnection(t *testing.T) {
+	returned := make(chan error, 1)
+	s := NewServer(WithAddr(addr), WithPersister(&recordingPersister{}), WithByteCounters(true), WithMiddleware(func(next Handler) Handler {
+		return func(conn net.Conn, ctx context.Context) error {
+			err := next(conn, ctx)
+			returned <- err
+			return err
+		}
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	<-s.Ready()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(message + "\n"))
+	r := bufio.NewReader(conn)
+	mustReadLine(t, r)
+
+	if !s.CloseConnection(1) {
+		t.Fatal("Expected connection 1 to be found")
+	}
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatalf("Expected the handler to be interrupted but received '%v'", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the handler to return")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed but received '%v'", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(s.Connections()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if s.CloseConnection(1) {
+		t.Fatal("Expected the closed connection to be gone")
+	}
+}
+
+//writesConn counts the writes to the connection and remembers what was written
+type writesConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes int
+	buf    bytes.Buffer
+}
+
+func (c *writesConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes++
+	return c.buf.Write(p)
+}
+
+func (c *writesConn) written() (int, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes, c.buf.String()
+}
+
+//This test shows the echoes are batched with a flush interval.
+func TestFlushInterval(t *testing.T) {
+	s := NewServer(WithFlushInterval(20 * time.Millisecond))
+	conn := &writesConn{}
+	ctx := context.WithValue(context.Background(), connIDKey{}, uint64(1))
+	s.register(conn, ctx, nil)
+	for i := 0; i < 3; i++ {
+		if err := s.echo(conn, ctx, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if writes, _ := conn.written(); writes != 0 {
+		t.Fatalf("Expected the echoes to wait for the flush but there were %d writes", writes)
+	}
+	time.Sleep(100 * time.Millisecond)
+	want := strings.Repeat(message+"\n", 3)
+	if writes, echoes := conn.written(); writes != 1 || echoes != want {
+		t.Fatalf("Expected '%s' in a single write but received '%s' in %d writes", want, echoes, writes)
+	}
+}
+
+//This test shows the echoes that are still buffered are written before the connection is closed.
+func TestFlushIntervalClose(t *testing.T) {
+	a, _ := StartTest(t, WithPersister(&recordingPersister{}), WithFlushInterval(time.Hour))
+	conn, err := net.Dial("tcp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(message + "\n" + message + "\n"))
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if echoes, err := io.ReadAll(conn); string(echoes) != message+"\n"+message+"\n" {
+		t.Fatalf("Expected both echoes but received '%s' (%v)", echoes, err)
+	}
+}
+
+//This test shows a message sent right before the shutdown gets its complete echo,
+//even with Broadcast writing to the connection while it's closed
+func TestShutdownCompleteEcho(t *testing.T) {
+	long := strings.Repeat("a", 32*1024)
+	for _, interval := range []time.Duration{0, time.Hour} {
+		p := &recordingPersister{}
+		s := NewServer(WithAddr(addr), WithPersister(p), WithFlushInterval(interval))
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s.Run(ctx)
+		}()
+		<-s.Ready()
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		broadcasting := make(chan struct{})
+		go func() {
+			defer close(broadcasting)
+			for {
+				if n := s.Broadcast([]byte("news")); n == 0 && len(p.messages()) > 0 {
+					//the connection is closed
+					return
+				}
+			}
+		}()
+		conn.Write([]byte(long + "\n"))
+		for len(p.messages()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		echoes := 0
+		sc := bufio.NewScanner(conn)
+		sc.Buffer(nil, len(long)+1)
+		for sc.Scan() {
+			switch sc.Text() {
+			case long:
+				echoes++
+			case "news":
+			default:
+				t.Fatalf("Expected complete lines but received %d bytes", len(sc.Text()))
+			}
+		}
+		if echoes != 1 || sc.Err() != nil {
+			t.Fatalf("Expected the complete echo but received %d (%v)", echoes, sc.Err())
+		}
+		conn.Close()
+		<-broadcasting
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//This benchmark shows buffering the echoes of a connection writes every echo at once,
+//instead of the message and its terminator separately.
+//Run with: go test -bench Echo
+func BenchmarkEcho(b *testing.B) {
+	for _, buffered := range []bool{false, true} {
+		b.Run(fmt.Sprintf("buffered=%v", buffered), func(b *testing.B) {
+			s := NewServer()
+			conn := &writesConn{}
+			ctx := context.Background()
+			if buffered {
+				//only the connections handled by Serve are buffered
+				ctx = context.WithValue(ctx, connIDKey{}, uint64(1))
+				s.register(conn, ctx, nil)
+			}
+			msg := []byte(message)
+			for i := 0; i < b.N; i++ {
+				s.echo(conn, ctx, msg)
+				conn.buf.Reset()
+			}
+			b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/msg")
+		})
+	}
+}
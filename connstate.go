@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+)
+
+//ConnState is the state of a connection, see: WithConnState
+type ConnState int
+
+const (
+	//StateNew connections were accepted and are about to be handled
+	StateNew ConnState = iota
+	//StateActive connections are handling a message (with the default handler)
+	StateActive
+	//StateIdle connections are waiting for the next message (with the default handler)
+	StateIdle
+	//StateClosed connections were handled and closed
+	StateClosed
+)
+
+var connStateNames = map[ConnState]string{
+	StateNew:    "new",
+	StateActive: "active",
+	StateIdle:   "idle",
+	StateClosed: "closed",
+}
+
+func (c ConnState) String() string {
+	return connStateNames[c]
+}
+
+//setState reports the state of conn to the ConnState hook, if there is one
+func (s *Server) setState(conn net.Conn, state ConnState) {
+	if s.connState != nil {
+		s.connState(conn, state)
+	}
+}
+
+//CloseReason is why a connection was closed, see: ConnInfo and WithCloseHook
+type CloseReason int32
+
+const (
+	//CloseReasonUnknown connections are still handled, or their (custom) handler returned without a reason
+	CloseReasonUnknown CloseReason = iota
+	//CloseClientEOF connections were closed by the client
+	CloseClientEOF
+	//CloseReadError connections failed to read
+	CloseReadError
+	//CloseIdleTimeout connections were idle for too long, see: WithIdleTimeout and WithFirstByteTimeout
+	CloseIdleTimeout
+	//CloseShutdown connections were interrupted or drained when the server stopped
+	CloseShutdown
+	//CloseRateLimited connections violated the message rate limit too many times, see: WithMaxRateViolations
+	CloseRateLimited
+	//CloseMessageTooLarge connections sent a message larger than the maximum message size
+	CloseMessageTooLarge
+	//CloseTooManyBytes connections sent more than the maximum bytes per connection
+	CloseTooManyBytes
+	//CloseWriteTimeout connections stopped reading their echoes, see: WithWriteTimeout
+	CloseWriteTimeout
+	//CloseRejected connections were rejected by the message hook, see: WithMessageHook
+	CloseRejected
+	//ClosePersistError connections failed to persist a message, see: WithCloseOnPersistError and Disconnect
+	ClosePersistError
+	//CloseKicked connections were closed with CloseConnection
+	CloseKicked
+	//CloseWriteError connections failed to write, other than the client closing them
+	CloseWriteError
+	//CloseQuit connections were closed by the client's quit command, see: WithQuitCommand
+	CloseQuit
+)
+
+var closeReasonNames = map[CloseReason]string{
+	CloseReasonUnknown:   "unknown",
+	CloseClientEOF:       "client_eof",
+	CloseReadError:       "read_error",
+	CloseIdleTimeout:     "idle_timeout",
+	CloseShutdown:        "shutdown",
+	CloseRateLimited:     "rate_limited",
+	CloseMessageTooLarge: "message_too_large",
+	CloseTooManyBytes:    "too_many_bytes",
+	CloseWriteTimeout:    "write_timeout",
+	CloseRejected:        "rejected",
+	ClosePersistError:    "persist_error",
+	CloseKicked:          "kicked",
+	CloseWriteError:      "write_error",
+	CloseQuit:            "quit",
+}
+
+func (r CloseReason) String() string {
+	return closeReasonNames[r]
+}
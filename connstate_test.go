@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+//This test shows the states a connection goes through with the default handler.
+func TestConnState(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var states []ConnState
+	closed := make(chan struct{})
+	s := NewServer(WithPersister(&recordingPersister{}), WithConnState(func(conn net.Conn, state ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, state)
+		if state == StateClosed {
+			close(closed)
+		}
+	}))
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, context.Background())
+		close(finished)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		conn.Write([]byte(message + "\n"))
+		mustReadLine(t, r)
+	}
+	conn.Close()
+	<-closed
+	l.Close()
+	<-finished
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []ConnState{StateNew, StateActive, StateIdle, StateActive, StateIdle, StateClosed}
+	if !reflect.DeepEqual(states, expected) {
+		t.Fatalf("Expected %v but received %v", expected, states)
+	}
+}
+
+//This test shows the close hook gets why every connection was closed.
+func TestCloseReason(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		close  func(s *Server, conn net.Conn, cancel context.CancelFunc)
+		reason CloseReason
+	}{
+		{"client EOF", nil, func(s *Server, conn net.Conn, cancel context.CancelFunc) { conn.Close() }, CloseClientEOF},
+		{"shutdown", nil, func(s *Server, conn net.Conn, cancel context.CancelFunc) { cancel() }, CloseShutdown},
+		{"kicked", nil, func(s *Server, conn net.Conn, cancel context.CancelFunc) { s.CloseConnection(s.Connections()[0].ID) }, CloseKicked},
+		{"idle timeout", []Option{WithIdleTimeout(50 * time.Millisecond)}, func(s *Server, conn net.Conn, cancel context.CancelFunc) {}, CloseIdleTimeout},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			closed := make(chan ConnInfo, 1)
+			s := NewServer(append(tc.opts, WithPersister(&recordingPersister{}), WithCloseHook(func(info ConnInfo) {
+				closed <- info
+			}))...)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go s.Serve(l, ctx)
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte(message + "\n"))
+			mustReadLine(t, bufio.NewReader(conn))
+			tc.close(s, conn, cancel)
+			select {
+			case info := <-closed:
+				if info.CloseReason != tc.reason {
+					t.Fatalf("Expected the reason %v but received %v", tc.reason, info.CloseReason)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Expected the connection to be closed")
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net"
+)
+
+//connIDKey is the context key of the connection's ID
+type connIDKey struct{}
+
+//ConnID returns the ID of the connection handled with ctx.
+//Serve assigns every connection it accepts a unique, increasing ID starting at 1
+func ConnID(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(connIDKey{}).(uint64)
+	return id, ok
+}
+
+//remoteAddrKey is the context key of the client's address
+type remoteAddrKey struct{}
+
+//RemoteAddr returns the address of the client of the connection handled with ctx,
+//so middleware can identify clients without holding the connection
+func RemoteAddr(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(remoteAddrKey{}).(net.Addr)
+	return addr
+}
+
+//bytesKey is the context key of the connection's byte counters
+type bytesKey struct{}
+
+//ConnBytes returns the number of bytes read and written so far by the connection handled with ctx,
+//if the server counts them (see: WithByteCounters)
+func ConnBytes(ctx context.Context) (read, written int64, ok bool) {
+	c, ok := ctx.Value(bytesKey{}).(*countingConn)
+	if !ok {
+		return 0, 0, false
+	}
+	return c.read.Load(), c.written.Load(), true
+}
+
+//identityKey is the context key of the client's identity
+type identityKey struct{}
+
+//ClientIdentity returns the Common Name of the client certificate of the connection handled with ctx,
+//if the client sent one. Only a verified certificate is an identity,
+//e.g. with ClientAuth set to tls.RequireAndVerifyClientCert (see: WithTLSConfig)
+func ClientIdentity(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(identityKey{}).(string)
+	return id, ok
+}
+
+//rejectKey is the context key of the function that rejects the connection
+type rejectKey struct{}
+
+//RejectConnection closes the connection handled with ctx on a protocol violation,
+//e.g. from a message hook (see: WithMessageHook). It cancels the connection's context,
+//which interrupts a blocked read right away, and records CloseRejected as the close reason.
+//It reports whether ctx belongs to a connection accepted by Serve
+func RejectConnection(ctx context.Context) bool {
+	reject, ok := ctx.Value(rejectKey{}).(func())
+	if ok {
+		reject()
+	}
+	return ok
+}
+
+//serverNameKey is the context key of the TLS server name
+type serverNameKey struct{}
+
+//ServerName returns the server name the client of the connection handled with ctx asked for in its TLS handshake (SNI),
+//if it sent one. It selects the connection's virtual service, see: WithVirtualServices
+func ServerName(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(serverNameKey{}).(string)
+	return name, ok
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+//This test shows every connection gets its own increasing ID.
+func TestConnID(t *testing.T) {
+	if _, ok := ConnID(context.Background()); ok {
+		t.Fatal("Expected no connection ID outside of a connection")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(chan uint64)
+	s := NewServer(WithHandler(NoError(func(conn net.Conn, ctx context.Context) {
+		id, ok := ConnID(ctx)
+		if !ok {
+			t.Error("Expected a connection ID")
+		}
+		ids <- id
+	})))
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, context.Background())
+		close(finished)
+	}()
+
+	for i := uint64(1); i <= 3; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := <-ids; id != i {
+			t.Fatalf("Expected connection ID %d but received %d", i, id)
+		}
+		conn.Close()
+	}
+	l.Close()
+	<-finished
+}
+
+//This test shows the client's address is available in the handler's context.
+func TestRemoteAddr(t *testing.T) {
+	if addr := RemoteAddr(context.Background()); addr != nil {
+		t.Fatalf("Expected no remote address outside of a connection but received '%v'", addr)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := make(chan net.Addr)
+	s := NewServer(WithHandler(NoError(func(conn net.Conn, ctx context.Context) {
+		addrs <- RemoteAddr(ctx)
+	})))
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, context.Background())
+		close(finished)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if addr := <-addrs; addr == nil || addr.String() != conn.LocalAddr().String() {
+		t.Fatalf("Expected '%v' but received '%v'", conn.LocalAddr(), addr)
+	}
+	l.Close()
+	<-finished
+}
+
+//This test shows a protocol violation cancels the connection's context, which closes it right away.
+func TestRejectConnection(t *testing.T) {
+	if RejectConnection(context.Background()) {
+		t.Fatal("Expected no connection to reject outside of a connection")
+	}
+
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		response string
+	}{
+		{"message hook", []Option{WithMessageHook(func(ctx context.Context, msg []byte) (bool, bool, error) {
+			if string(msg) == message {
+				//no error, the handler only finds out through its context
+				RejectConnection(ctx)
+				return false, false, nil
+			}
+			return true, true, nil
+		})}, ""},
+		{"strict JSON", []Option{WithJSONValidation(true), WithStrictProtocol(true)}, "ERR invalid json\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			closed := make(chan ConnInfo, 1)
+			p := &recordingPersister{}
+			s := NewServer(append(tc.opts, WithPersister(p), WithCloseHook(func(info ConnInfo) {
+				closed <- info
+			}))...)
+			go s.Serve(l, context.Background())
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			conn.Write([]byte(message + "\n"))
+			resp, err := io.ReadAll(bufio.NewReader(conn))
+			if err != nil {
+				t.Fatalf("Expected the connection to be closed but received %v", err)
+			}
+			if string(resp) != tc.response {
+				t.Fatalf("Expected '%s' but received '%s'", tc.response, resp)
+			}
+			if info := <-closed; info.CloseReason != CloseRejected {
+				t.Fatalf("Expected the reason %v but received %v", CloseRejected, info.CloseReason)
+			}
+			if msgs := p.messages(); len(msgs) != 0 {
+				t.Fatalf("Expected nothing to be persisted but received %v", msgs)
+			}
+		})
+	}
+}
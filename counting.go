@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+//countingConn counts the bytes read from and written to the connection it wraps.
+//The counters may be read while the connection is in use
+type countingConn struct {
+	net.Conn
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+//Unwrap returns the accepted connection, e.g. to get to the *net.TCPConn
+func (c *countingConn) Unwrap() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+//This test shows the byte counters match what the client sent and received
+//and are logged when the connection is closed.
+func TestByteCounters(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs syncBuffer
+	type counts struct{ read, written int64 }
+	countsCh := make(chan counts, 1)
+	s := NewServer(WithByteCounters(true), WithPersister(&recordingPersister{}), WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		WithMiddleware(func(next Handler) Handler {
+			return func(conn net.Conn, ctx context.Context) error {
+				err := next(conn, ctx)
+				read, written, _ := ConnBytes(ctx)
+				countsCh <- counts{read, written}
+				return err
+			}
+		}))
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, context.Background())
+		close(finished)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := message + "\n"
+	conn.Write([]byte(line))
+	if echo, err := bufio.NewReader(conn).ReadString('\n'); echo != line {
+		t.Fatalf("Expected '%s' but received '%s' (%v)", message, echo, err)
+	}
+	conn.Close()
+
+	if c := <-countsCh; c.read != int64(len(line)) || c.written != int64(len(line)) {
+		t.Fatalf("Expected %d bytes read and written but received read=%d wrote=%d", len(line), c.read, c.written)
+	}
+	l.Close()
+	<-finished
+	if !strings.Contains(logs.String(), "read=5 wrote=5") {
+		t.Fatalf("Expected the counts to be logged but received:\n%s", logs.String())
+	}
+}
+
+//This test shows there are no counters unless the server counts bytes.
+func TestConnBytesDisabled(t *testing.T) {
+	if _, _, ok := ConnBytes(context.Background()); ok {
+		t.Fatal("Expected no counters")
+	}
+}
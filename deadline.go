@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+//noDeadline clears a deadline, unlike a time far in the future it never expires
+var noDeadline time.Time
+
+//readDeadliner is a net.Conn or a net.PacketConn
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+//interruptRead makes the current and future reads of c fail (see: persistAndEcho)
+func interruptRead(c readDeadliner) error {
+	return c.SetReadDeadline(aLongTimeAgo)
+}
+
+//clearReadDeadline makes reads of c block again, e.g. after interruptRead
+func clearReadDeadline(c readDeadliner) error {
+	return c.SetReadDeadline(noDeadline)
+}
+
+//clearWriteDeadline removes the write deadline of c
+func clearWriteDeadline(c interface{ SetWriteDeadline(t time.Time) error }) error {
+	return c.SetWriteDeadline(noDeadline)
+}
+
+//firstByteReader reads from r and calls arrived once the first byte arrives, see: WithFirstByteTimeout
+type firstByteReader struct {
+	r       io.Reader
+	started bool
+	arrived func()
+}
+
+func (f *firstByteReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if n > 0 && !f.started {
+		f.started = true
+		f.arrived()
+	}
+	return n, err
+}
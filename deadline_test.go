@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+//This test shows reads work again once an interrupted read deadline is cleared.
+func TestClearReadDeadline(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	interruptRead(servConn)
+	if _, err := servConn.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("Expected the read to be interrupted but received '%v'", err)
+	}
+
+	clearReadDeadline(servConn)
+	go func() {
+		time.Sleep(10 * time.Millisecond) //long after the interrupted deadline was set
+		cliConn.Write([]byte("x"))
+	}()
+	b := make([]byte, 1)
+	if _, err := servConn.Read(b); err != nil || b[0] != 'x' {
+		t.Fatalf("Expected to read 'x' but received '%s' (%v)", b, err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"container/list"
+	"hash/maphash"
+	"time"
+)
+
+//dedupSize is the number of recent messages a connection remembers, see: WithDedup
+const dedupSize = 64
+
+//dedup remembers the hashes of the last messages a connection sent, least recently seen at the back
+type dedup struct {
+	window time.Duration
+	seed   maphash.Seed
+	seen   map[uint64]*list.Element
+	order  *list.List
+}
+
+//seenMessage is a message hash and when it was persisted
+type seenMessage struct {
+	hash uint64
+	at   time.Time
+}
+
+func newDedup(window time.Duration) *dedup {
+	return &dedup{window: window, seed: maphash.MakeSeed(), seen: make(map[uint64]*list.Element), order: list.New()}
+}
+
+//duplicate reports whether msg was persisted less than window ago
+func (d *dedup) duplicate(msg []byte, now time.Time) bool {
+	e, ok := d.seen[maphash.Bytes(d.seed, msg)]
+	if !ok {
+		return false
+	}
+	d.order.MoveToFront(e)
+	return now.Sub(e.Value.(*seenMessage).at) < d.window
+}
+
+//remember remembers msg was persisted now, forgetting the least recently seen message if it has to.
+//Only persisted messages count, a retransmission of one that failed to persist isn't a duplicate
+func (d *dedup) remember(msg []byte, now time.Time) {
+	h := maphash.Bytes(d.seed, msg)
+	if e, ok := d.seen[h]; ok {
+		//the window is counted from the message that was persisted last
+		d.order.MoveToFront(e)
+		e.Value.(*seenMessage).at = now
+		return
+	}
+	d.seen[h] = d.order.PushFront(&seenMessage{hash: h, at: now})
+	if d.order.Len() > dedupSize {
+		delete(d.seen, d.order.Remove(d.order.Back()).(*seenMessage).hash)
+	}
+}
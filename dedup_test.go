@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+//This test shows a duplicate message is echoed but not persisted again within the window
+func TestPersistAndEchoDedup(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte, 3)
+	s := NewServer(WithMessageChannel(mCh), WithDedup(time.Minute))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	r := bufio.NewReader(cliConn)
+	for _, msg := range []string{message, message, "other"} {
+		fmt.Fprintln(cliConn, msg)
+		if echo := mustReadLine(t, r); echo != msg+"\n" {
+			t.Fatalf("Expected the echo %q but received %q", msg, echo)
+		}
+	}
+	if len(mCh) != 2 {
+		t.Fatalf("Expected 2 messages in mCh but received %d", len(mCh))
+	}
+	if got := string(<-mCh); got != message {
+		t.Fatalf("Expected %q but received %q", message, got)
+	}
+	if got := string(<-mCh); got != "other" {
+		t.Fatalf("Expected 'other' but received %q", got)
+	}
+	if deduped := s.DedupedMessages(); deduped != 1 {
+		t.Fatalf("Expected 1 deduped message but received %d", deduped)
+	}
+}
+
+//This test shows a message is persisted again once the window passes, and the oldest messages are forgotten
+func TestDedupWindow(t *testing.T) {
+	d := newDedup(time.Second)
+	now := time.Now()
+	if d.duplicate([]byte(message), now) {
+		t.Fatal("Expected the first message not to be a duplicate")
+	}
+	d.remember([]byte(message), now)
+	if !d.duplicate([]byte(message), now.Add(time.Second/2)) {
+		t.Fatal("Expected a duplicate within the window")
+	}
+	if d.duplicate([]byte(message), now.Add(time.Second)) {
+		t.Fatal("Expected no duplicate after the window")
+	}
+	d.remember([]byte(message), now.Add(time.Second))
+	for i := 0; i < dedupSize; i++ {
+		d.remember([]byte(fmt.Sprint(i)), now)
+	}
+	if d.duplicate([]byte(message), now.Add(time.Second)) {
+		t.Fatal("Expected the least recently seen message to be forgotten")
+	}
+}
+
+//This test shows a retransmission of a message that failed to persist is persisted, not deduped.
+func TestPersistAndEchoDedupPersistError(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	p := &recordingPersister{err: errors.New("disk full")}
+	s := NewServer(WithPersister(p), WithDedup(time.Minute))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	r := bufio.NewReader(cliConn)
+	fmt.Fprintln(cliConn, message)
+	mustReadLine(t, r)
+	p.mu.Lock()
+	p.err = nil
+	p.mu.Unlock()
+	fmt.Fprintln(cliConn, message)
+	mustReadLine(t, r)
+	if msgs := p.messages(); len(msgs) != 2 {
+		t.Fatalf("Expected the message to be persisted twice but received %v", msgs)
+	}
+	if deduped := s.DedupedMessages(); deduped != 0 {
+		t.Fatalf("Expected no deduped messages but received %d", deduped)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+//errDraining stops reading from a connection once the server is shutting down
+var errDraining = errors.New("server shutting down")
+
+//messageReader reads the messages of a connection for the default handler.
+//During a graceful shutdown it stops reading once no message is partially received,
+//so all the messages that were fully received are still handled (drained).
+//A read that is waiting for the next message is interrupted when the shutdown starts (see: watchShutdown)
+type messageReader struct {
+	s       *Server
+	r       io.Reader
+	conn    net.Conn
+	ctx     context.Context
+	pending bool  //the scanner holds part of a message
+	err     error //the last read error
+}
+
+func (m *messageReader) Read(p []byte) (int, error) {
+	for {
+		if !m.pending && m.s.shuttingDown() {
+			m.err = errDraining
+			return 0, m.err
+		}
+		var n int
+		n, m.err = m.r.Read(p)
+		if n > 0 || !isTimeout(m.err) || !m.s.shuttingDown() || m.ctx.Err() != nil {
+			return n, m.err
+		}
+		if !m.pending {
+			//interrupted while waiting for the next message
+			m.err = errDraining
+			return 0, m.err
+		}
+		//the shutdown interrupted the rest of a message, give the client its idle timeout to send it
+		clearReadDeadline(m.conn)
+		m.s.resetIdleDeadline(m.conn, m.ctx)
+	}
+}
+
+//watchShutdown interrupts the read of conn when the graceful shutdown starts, until the handler is done.
+//A connection waiting for its next message has nothing left to drain, see: messageReader
+func (s *Server) watchShutdown(conn net.Conn, done <-chan struct{}) {
+	select {
+	case <-s.shutdown:
+		interruptRead(conn)
+	case <-done:
+	}
+}
+
+//split wraps the framer's split function to keep track of partial messages.
+//Only a client closing the connection ends the last message,
+//an interrupted read leaves it incomplete unless the server persists unterminated messages
+func (m *messageReader) split(split bufio.SplitFunc) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		interrupted := atEOF && m.err != io.EOF
+		if interrupted && !m.s.persistUnterminated {
+			atEOF = false
+		}
+		advance, token, err := split(data, atEOF)
+		m.pending = len(data) > advance
+		return advance, token, err
+	}
+}
+
+//DrainStats counts the messages handled during a graceful shutdown, see: ShutdownAndReport
+type DrainStats struct {
+	//Drained messages were persisted after the shutdown started
+	Drained int64
+	//Dropped messages were received but not persisted because the connection was interrupted
+	Dropped int64
+}
+
+//ShutdownAndReport is Shutdown, reporting how many messages were drained and dropped.
+//Every message that was fully received before the shutdown is persisted,
+//unless ctx is done first and the connections are interrupted
+func (s *Server) ShutdownAndReport(ctx context.Context) (DrainStats, error) {
+	err := s.Shutdown(ctx)
+	return DrainStats{Drained: s.drained.Load(), Dropped: s.dropped.Load()}, err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+//gatePersister holds the first message until it's released
+type gatePersister struct {
+	recordingPersister
+	first   chan struct{}
+	release chan struct{}
+}
+
+func (p *gatePersister) Persist(ctx context.Context, msg []byte) error {
+	if len(p.messages()) == 0 {
+		close(p.first)
+		<-p.release
+	}
+	return p.recordingPersister.Persist(ctx, msg)
+}
+
+//This test shows a shutdown in the middle of a burst persists all the messages
+//the server already received and reports them as drained.
+func TestShutdownDrainsMessages(t *testing.T) {
+	const n = 10
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &gatePersister{first: make(chan struct{}), release: make(chan struct{})}
+	s := NewServer(WithPersister(p), WithEcho(false))
+	go s.Serve(l, context.Background())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var burst []byte
+	for i := 0; i < n; i++ {
+		burst = fmt.Appendf(burst, "%s %d\n", message, i)
+	}
+	conn.Write(burst)
+	<-p.first //the rest of the burst waits in the handler
+
+	type result struct {
+		stats DrainStats
+		err   error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		stats, err := s.ShutdownAndReport(context.Background())
+		resCh <- result{stats, err}
+	}()
+	for !s.shuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+	close(p.release)
+
+	res := <-resCh
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	msgs := p.messages()
+	if len(msgs) != n {
+		t.Fatalf("Expected all %d messages to be persisted but received %v", n, msgs)
+	}
+	for i, m := range msgs {
+		if expected := fmt.Sprintf("%s %d", message, i); m != expected {
+			t.Fatalf("Expected '%s' but received '%s'", expected, m)
+		}
+	}
+	if res.stats != (DrainStats{Drained: n}) {
+		t.Fatalf("Expected %d drained messages but received %+v", n, res.stats)
+	}
+}
+
+//This test shows an interrupted connection doesn't persist a partially received message.
+func TestPersistAndEchoInterruptedPartialMessage(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	p := &recordingPersister{}
+	s := NewServer(WithPersister(p))
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.persistAndEcho(servConn, ctx)
+	}()
+
+	cliConn.Write([]byte(message)) //no newline yet
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-errCh
+	if msgs := p.messages(); len(msgs) != 0 {
+		t.Fatalf("Expected no messages but received %v", msgs)
+	}
+}
+
+//This test shows a shutdown doesn't wait for idle connections, they have nothing left to drain,
+//nor for a partial message any longer than it takes the client to send the rest.
+func TestShutdownIdleConnection(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &recordingPersister{}
+	s := NewServer(WithPersister(p))
+	go s.Serve(l, context.Background())
+
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.Write([]byte(message + "\n"))
+	mustReadLine(t, bufio.NewReader(idle))
+	partial, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer partial.Close()
+	partial.Write([]byte(message[:1]))
+	if err := s.WaitForConnections(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	//give the server time to read the first byte
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Shutdown(ctx)
+	}()
+	for !s.shuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	partial.Write([]byte(message[1:] + "\n"))
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Expected a clean drain but received '%v'", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the shutdown not to wait for the idle connection")
+	}
+	if msgs := p.messages(); len(msgs) != 2 || msgs[1] != message {
+		t.Fatalf("Expected the partial message to be drained but received %v", msgs)
+	}
+}
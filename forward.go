@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+//forwardQueueSize is the number of messages waiting to be forwarded before new ones are dropped
+const forwardQueueSize = 1024
+
+//forwarder forwards the persisted messages to an upstream server, see: WithForwardTo
+type forwarder struct {
+	addr        string
+	dialTimeout time.Duration
+	queue       chan []byte
+	//stop is closed to stop the running forwarder, nil while none is running (guarded by mu)
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+//forward queues msg for the upstream, if there is one.
+//It never blocks the handler, when the upstream can't keep up the message is dropped
+func (s *Server) forward(msg []byte) {
+	f := s.forwarder
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	if f.stop == nil {
+		f.stop = make(chan struct{})
+		go s.runForwarder(f, f.stop)
+	}
+	f.mu.Unlock()
+	select {
+	case f.queue <- msg:
+	default:
+		s.logger.Warn("Forward queue is full, dropping message", "upstream", f.addr)
+	}
+}
+
+//stopForwarder stops the forwarder once the server stopped serving, see: stopServing.
+//The next message that's forwarded starts it again
+func (s *Server) stopForwarder() {
+	f := s.forwarder
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+}
+
+//runForwarder writes the queued messages to the upstream until stop is closed or Run returns,
+//(re)connecting and retrying with an increasing delay (up to 5s) when it fails
+func (s *Server) runForwarder(f *forwarder, stop <-chan struct{}) {
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	var delay time.Duration
+	for {
+		var msg []byte
+		select {
+		case msg = <-f.queue:
+		case <-stop:
+			return
+		case <-s.done:
+			return
+		}
+		for {
+			var err error
+			if conn == nil {
+				conn, err = net.DialTimeout("tcp", f.addr, f.dialTimeout)
+			}
+			if err == nil {
+				err = s.writeFrame(conn, s.framer, msg)
+			}
+			if err == nil {
+				delay = 0
+				break
+			}
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+			delay = min(max(2*delay, 50*time.Millisecond), 5*time.Second)
+			s.logger.Warn("Forwarding message failed, retrying", "upstream", f.addr, "err", err, "delay", delay)
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				return
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+//This test shows the persisted messages are forwarded to the upstream in order.
+func TestForwardTo(t *testing.T) {
+	upstream, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	lines := make(chan string)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sc := bufio.NewScanner(conn)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+	}()
+
+	addr, _ := StartTest(t, WithForwardTo(upstream.Addr().String(), time.Second), WithMessageConsumer(func([]byte) {}))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(conn, "%s %d\n", message, i)
+		mustReadLine(t, r)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case line := <-lines:
+			if expected := fmt.Sprintf("%s %d", message, i); line != expected {
+				t.Fatalf("Expected '%s' to be forwarded but received '%s'", expected, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the message to be forwarded")
+		}
+	}
+}
+
+//This test shows forwarding keeps retrying until the upstream is reachable, without blocking the handler.
+func TestForwardToRetries(t *testing.T) {
+	//reserve a port nobody listens on yet
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamAddr := l.Addr().String()
+	l.Close()
+
+	s := NewServer(WithForwardTo(upstreamAddr, 100*time.Millisecond), WithPersister(&recordingPersister{}))
+	cliConn, servConn := tcpPair(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+	defer close(s.done) //stops the forwarder, like Run returning
+
+	cliConn.Write([]byte(message + "\n"))
+	//the echo doesn't wait for the upstream
+	if echo := mustReadLine(t, bufio.NewReader(cliConn)); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s'", message, echo)
+	}
+
+	time.Sleep(100 * time.Millisecond) //a failed attempt or two
+	upstream, err := net.Listen("tcp", upstreamAddr)
+	if err != nil {
+		t.Skipf("The port was taken in the meantime: %v", err)
+	}
+	defer upstream.Close()
+	conn, err := upstream.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if line := mustReadLine(t, bufio.NewReader(conn)); line != message+"\n" {
+		t.Fatalf("Expected '%s' to be forwarded but received '%s'", message, line)
+	}
+}
+
+//This test shows the forwarder stops and closes its upstream connection when the last Serve call returns.
+func TestForwardToStopsWithServe(t *testing.T) {
+	upstream, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(WithForwardTo(upstream.Addr().String(), time.Second), WithPersister(&recordingPersister{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, ctx)
+		close(finished)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(message + "\n"))
+	mustReadLine(t, bufio.NewReader(conn))
+	forwarded, err := upstream.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forwarded.Close()
+	r := bufio.NewReader(forwarded)
+	mustReadLine(t, r)
+
+	cancel()
+	l.Close()
+	<-finished
+	forwarded.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the upstream connection to be closed but received '%v'", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+//Framer splits the stream read from a client into messages (frames)
+//and writes messages to a client as frames.
+//Frames are read with a bufio.Scanner, so they are limited by WithMaxLineSize
+type Framer interface {
+	//Split is the bufio.SplitFunc returning the next frame's message
+	Split(data []byte, atEOF bool) (advance int, token []byte, err error)
+	//WriteFrame writes msg to w as a single frame
+	WriteFrame(w io.Writer, msg []byte) error
+}
+
+//LineFramer frames messages as lines ending with Terminator.
+//Without a Terminator (or with an empty one) lines end with "\n",
+//optionally preceded by a "\r" which is dropped
+type LineFramer struct {
+	Terminator []byte
+}
+
+func (f LineFramer) Split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(f.Terminator) == 0 {
+		return bufio.ScanLines(data, atEOF)
+	}
+	return scanTerminated(f.Terminator)(data, atEOF)
+}
+
+func (f LineFramer) WriteFrame(w io.Writer, msg []byte) error {
+	terminator := f.Terminator
+	if len(terminator) == 0 {
+		terminator = []byte("\n")
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	_, err := w.Write(terminator)
+	return err
+}
+
+//scanTerminated returns a split function for lines ending with terminator.
+//Like bufio.ScanLines, the last line doesn't have to be terminated
+func scanTerminated(terminator []byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if i := bytes.Index(data, terminator); i >= 0 {
+			return i + len(terminator), data[:i], nil
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		//request more data
+		return 0, nil, nil
+	}
+}
+
+//LengthPrefixedFramer frames messages with a 4 byte big-endian length header,
+//so messages can contain any byte, including newlines
+type LengthPrefixedFramer struct{}
+
+const lengthPrefixSize = 4
+
+func (LengthPrefixedFramer) Split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if len(data) >= lengthPrefixSize {
+		n := int(binary.BigEndian.Uint32(data))
+		if len(data) >= lengthPrefixSize+n {
+			return lengthPrefixSize + n, data[lengthPrefixSize : lengthPrefixSize+n], nil
+		}
+	}
+	if atEOF {
+		//the client went away in the middle of a frame
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	//request more data
+	return 0, nil, nil
+}
+
+func (LengthPrefixedFramer) WriteFrame(w io.Writer, msg []byte) error {
+	frame := make([]byte, lengthPrefixSize+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	copy(frame[lengthPrefixSize:], msg)
+	_, err := w.Write(frame)
+	return err
+}
+
+//splitFramer reads the messages with its own split function, see: WithSplitFunc.
+//The echoes are written by the Framer it replaces
+type splitFramer struct {
+	split bufio.SplitFunc
+	Framer
+}
+
+func (f splitFramer) Split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	return f.split(data, atEOF)
+}
+
+//maxFrameOverhead returns how many bytes the built-in framers add to a message,
+//so WithMaxLineSize limits the messages themselves
+func maxFrameOverhead(f Framer) int {
+	switch f := f.(type) {
+	case LineFramer:
+		if len(f.Terminator) == 0 {
+			return len("\r\n")
+		}
+		return len(f.Terminator)
+	case LengthPrefixedFramer:
+		return lengthPrefixSize
+	case webSocketFramer:
+		return maxWebSocketHeader
+	case splitFramer:
+		//a guess, the delimiters are usually as long as the echo's
+		return maxFrameOverhead(f.Framer)
+	}
+	return 0
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"testing"
+)
+
+//This test shows CRLF terminated lines are echoed with the same terminator.
+func TestLineTerminator(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte)
+	s := NewServer(WithMessageChannel(mCh), WithLineTerminator([]byte("\r\n")))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	//the \n alone doesn't end a line
+	cliConn.Write([]byte("one\ntwo\r\nthree\r\n"))
+	for _, expected := range []string{"one\ntwo", "three"} {
+		if m := <-mCh; string(m) != expected {
+			t.Fatalf("Expected %q but received %q", expected, m)
+		}
+	}
+
+	expected := "one\ntwo\r\nthree\r\n"
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(cliConn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != expected {
+		t.Fatalf("Expected %q but received %q", expected, buf)
+	}
+}
+
+//This test shows NUL-delimited messages are echoed with a NUL.
+func TestDelimiter(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte)
+	s := NewServer(WithMessageChannel(mCh), WithDelimiter(0))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	cliConn.Write([]byte("one\ntwo\x00three\x00"))
+	for _, expected := range []string{"one\ntwo", "three"} {
+		if m := <-mCh; string(m) != expected {
+			t.Fatalf("Expected %q but received %q", expected, m)
+		}
+	}
+	expected := "one\ntwo\x00three\x00"
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(cliConn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != expected {
+		t.Fatalf("Expected %q but received %q", expected, buf)
+	}
+}
+
+//This test shows a custom split function splits the messages while the echoes keep the framer's terminator.
+func TestSplitFunc(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte)
+	s := NewServer(WithMessageChannel(mCh), WithLineTerminator([]byte(";")), WithSplitFunc(bufio.ScanWords))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	cliConn.Write([]byte("one two\tthree "))
+	for _, expected := range []string{"one", "two", "three"} {
+		if m := <-mCh; string(m) != expected {
+			t.Fatalf("Expected %q but received %q", expected, m)
+		}
+	}
+	expected := "one;two;three;"
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(cliConn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != expected {
+		t.Fatalf("Expected %q but received %q", expected, buf)
+	}
+}
+
+//This test shows the default LineFramer keeps the current behavior.
+func TestLineFramer(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte)
+	s := NewServer(WithMessageChannel(mCh), WithFraming(LineFramer{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	cliConn.Write([]byte("one\r\ntwo\n"))
+	for _, expected := range []string{"one", "two"} {
+		if m := <-mCh; string(m) != expected {
+			t.Fatalf("Expected %q but received %q", expected, m)
+		}
+	}
+	expected := "one\ntwo\n"
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(cliConn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != expected {
+		t.Fatalf("Expected %q but received %q", expected, buf)
+	}
+}
+
+//This test shows binary messages with embedded newlines are read and echoed as single frames.
+func TestLengthPrefixedFramer(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte)
+	s := NewServer(WithMessageChannel(mCh), WithFraming(LengthPrefixedFramer{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	msgs := [][]byte{{0, '\n', 1, '\r', '\n', 255}, {}, []byte(message)}
+	var frames bytes.Buffer
+	for _, msg := range msgs {
+		LengthPrefixedFramer{}.WriteFrame(&frames, msg)
+	}
+	//the frames arrive in pieces
+	go func() {
+		for _, b := range frames.Bytes() {
+			cliConn.Write([]byte{b})
+		}
+	}()
+
+	for _, expected := range msgs {
+		if m := <-mCh; !bytes.Equal(m, expected) {
+			t.Fatalf("Expected %q but received %q", expected, m)
+		}
+	}
+	buf := make([]byte, frames.Len())
+	if _, err := io.ReadFull(cliConn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, frames.Bytes()) {
+		t.Fatalf("Expected %q but received %q", frames.Bytes(), buf)
+	}
+}
+
+//This test shows error responses are framed like the echoes.
+func TestErrorResponseFraming(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		framer Framer
+		opts   []Option
+		resp   string
+	}{
+		{"invalid json, length prefixed", LengthPrefixedFramer{}, []Option{WithJSONValidation(true)}, "ERR invalid json"},
+		{"invalid json, CRLF", LineFramer{Terminator: []byte("\r\n")}, []Option{WithJSONValidation(true)}, "ERR invalid json"},
+		{"too large, length prefixed", LengthPrefixedFramer{}, []Option{WithMaxMessageSize(2)}, "ERR message too large"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cliConn, servConn := tcpPair(t)
+			s := NewServer(append(tc.opts, WithPersister(&recordingPersister{}), WithFraming(tc.framer))...)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go s.persistAndEcho(servConn, ctx)
+
+			var frame, want bytes.Buffer
+			tc.framer.WriteFrame(&frame, []byte(message))
+			tc.framer.WriteFrame(&want, []byte(tc.resp))
+			cliConn.Write(frame.Bytes())
+			buf := make([]byte, want.Len())
+			if _, err := io.ReadFull(cliConn, buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, want.Bytes()) {
+				t.Fatalf("Expected %q but received %q", want.Bytes(), buf)
+			}
+		})
+	}
+}
+
+//This test shows an empty terminator falls back to the default lines.
+func TestLineFramerEmptyTerminator(t *testing.T) {
+	f := LineFramer{Terminator: []byte{}}
+	advance, token, err := f.Split([]byte("one\ntwo"), false)
+	if advance != 4 || string(token) != "one" || err != nil {
+		t.Fatalf("Expected to split 'one' but received %d, %q, %v", advance, token, err)
+	}
+	var buf bytes.Buffer
+	f.WriteFrame(&buf, []byte("one"))
+	if buf.String() != "one\n" {
+		t.Fatalf("Expected %q but received %q", "one\n", buf.String())
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+//halfCloseWait is how long a half closed connection waits for the client to close its end, see: WithHalfCloseOnShutdown
+const halfCloseWait = time.Second
+
+//errNoCloseWrite is returned for connections that can't be half closed, e.g. the ends of a net.Pipe
+var errNoCloseWrite = errors.New("connection can't be half closed")
+
+//closeWriter is implemented by *net.TCPConn, *net.UnixConn and *tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+//closeWrite half closes the first connection conn wraps that can be half closed
+func closeWrite(conn net.Conn) error {
+	for {
+		if cw, ok := conn.(closeWriter); ok {
+			return cw.CloseWrite()
+		}
+		u, ok := conn.(interface{ Unwrap() net.Conn })
+		if !ok {
+			return errNoCloseWrite
+		}
+		conn = u.Unwrap()
+	}
+}
+
+//CloseWrite ends the gzip stream and half closes the connection
+func (c *gzipConn) CloseWrite() error {
+	c.endStream()
+	return closeWrite(c.Conn)
+}
+
+//closeConn closes conn after the echoes were flushed.
+//With WithHalfCloseOnShutdown the client gets an EOF first and a moment to close its end,
+//so it knows it got everything rather than seeing a reset
+func (s *Server) closeConn(conn net.Conn) error {
+	if s.halfClose && closeWrite(conn) == nil {
+		//the handler is done reading, whatever the client still sends is dropped
+		raw := unwrapConn(conn)
+		raw.SetReadDeadline(time.Now().Add(halfCloseWait))
+		io.Copy(io.Discard, raw)
+	}
+	return conn.Close()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+//This test shows that with WithHalfCloseOnShutdown the client reads the echoes and then an EOF,
+//and the server waits for the client to close its end before closing the connection
+func TestPersistAndEchoHalfClose(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	s := NewServer(WithPersister(&recordingPersister{}), WithHalfCloseOnShutdown(true))
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.handleConn(servConn, ctx)
+	}()
+
+	r := bufio.NewReader(cliConn)
+	fmt.Fprintln(cliConn, message)
+	mustReadLine(t, r)
+	cancel()
+	cliConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected an EOF after the half close but received '%v'", err)
+	}
+	select {
+	case <-errCh:
+		t.Fatal("Expected the server to wait for the client to close")
+	case <-time.After(halfCloseWait / 4):
+	}
+	cliConn.Close()
+	select {
+	case <-errCh:
+	case <-time.After(halfCloseWait / 2):
+		t.Fatal("Expected the server to close the connection once the client did")
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+//setKeepAlive enables TCP keep-alives on conn, if they are configured (see: WithKeepAlive).
+//Connections that aren't TCP are left alone
+func (s *Server) setKeepAlive(conn net.Conn) error {
+	if s.keepAlive <= 0 {
+		return nil
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(s.keepAlive)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//sockoptInt reads an int socket option of conn
+func sockoptInt(t *testing.T, conn *net.TCPConn, level, opt int) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		v, optErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return v
+}
+
+//This test shows the accepted connections have keep-alives enabled with the configured period.
+func TestKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan *net.TCPConn, 1)
+	s := NewServer(WithKeepAlive(42*time.Second), WithHandler(NoError(func(conn net.Conn, ctx context.Context) {
+		conns <- conn.(*net.TCPConn)
+		<-ctx.Done()
+	})))
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, ctx)
+		close(finished)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tcpConn := <-conns
+	if v := sockoptInt(t, tcpConn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v != 1 {
+		t.Fatalf("Expected keep-alives to be enabled but received %d", v)
+	}
+	if v := sockoptInt(t, tcpConn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); v != 42 {
+		t.Fatalf("Expected keep-alives every 42s but received %ds", v)
+	}
+	cancel()
+	l.Close()
+	<-finished
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+//This test shows connections that aren't TCP are left alone.
+func TestKeepAliveNotTCP(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if err := NewServer(WithKeepAlive(time.Second)).setKeepAlive(c1); err != nil {
+		t.Fatalf("Expected no error but received '%v'", err)
+	}
+}
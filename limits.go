@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+//ErrRateLimited is returned by the default handler when a client keeps sending
+//messages faster than the rate limit (see: WithMessageRateLimit)
+var ErrRateLimited = errors.New("message rate limit exceeded")
+
+//ErrTooManyBytes is returned by the default handler when a client sends more bytes
+//than allowed for a single connection (see: WithMaxBytesPerConnection)
+var ErrTooManyBytes = errors.New("connection exceeds the maximum number of bytes")
+
+//acquireIP counts a connection from addr's IP, if the connections per IP are limited.
+//It returns the IP to release once the connection is closed, and false if the IP is over the limit
+func (s *Server) acquireIP(addr net.Addr) (string, bool) {
+	if s.maxConnsPerIP <= 0 {
+		return "", true
+	}
+	ip := ipOf(addr)
+	if ip == "" { //e.g. unix sockets
+		return "", true
+	}
+	s.ipMu.Lock()
+	defer s.ipMu.Unlock()
+	if s.connsPerIP[ip] >= s.maxConnsPerIP {
+		return "", false
+	}
+	s.connsPerIP[ip]++
+	return ip, true
+}
+
+func (s *Server) releaseIP(ip string) {
+	if ip == "" {
+		return
+	}
+	s.ipMu.Lock()
+	defer s.ipMu.Unlock()
+	if s.connsPerIP[ip]--; s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+}
+
+//allowed reports whether the client at addr may connect, see: WithIPAllowList and WithIPDenyList.
+//The deny list takes precedence, addresses without an IP (e.g. unix sockets) are always allowed
+func (s *Server) allowed(addr net.Addr) bool {
+	if len(s.allowList) == 0 && len(s.denyList) == 0 {
+		return true
+	}
+	ip := net.ParseIP(ipOf(addr))
+	if ip == nil {
+		return true
+	}
+	for _, n := range s.denyList {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(s.allowList) == 0 {
+		return true
+	}
+	for _, n := range s.allowList {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//ipOf returns the IP of a host:port address, or "" if it doesn't have one
+func ipOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+//tokenBucket allows rate messages per second on average, with bursts of up to burst messages.
+//It belongs to a single connection so it isn't safe for concurrent use
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+//reserve takes a token and returns how long to wait before it's available (0 if it's available now)
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+//newRateLimiter returns the connection's token bucket, or nil if messages aren't rate limited
+func (s *Server) newRateLimiter(l *Limits) *tokenBucket {
+	if l.MessageRate <= 0 {
+		return nil
+	}
+	return newTokenBucket(l.MessageRate, l.MessageBurst, time.Now())
+}
+
+//waitForToken paces the connection according to the rate limit.
+//It returns ErrRateLimited once the connection violated the limit too many times
+//and the context's error if it was cancelled while waiting
+func (s *Server) waitForToken(b *tokenBucket, violations *int, ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	wait := b.reserve(time.Now())
+	if wait <= 0 {
+		return nil
+	}
+	*violations++
+	if s.maxRateViolations > 0 && *violations >= s.maxRateViolations {
+		return ErrRateLimited
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//bytesLimitReader reads up to max bytes from r and fails with ErrTooManyBytes
+//if r has more to give, unlike io.LimitReader which pretends the rest isn't there
+type bytesLimitReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func (r *bytesLimitReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.n >= r.max {
+		//if the client is done, so are we
+		var b [1]byte
+		if n, err := r.r.Read(b[:]); n == 0 {
+			return 0, err
+		}
+		return 0, ErrTooManyBytes
+	}
+	if rem := r.max - r.n; int64(len(p)) > rem {
+		p = p[:rem]
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+//limitBytes limits the bytes read from conn, if they are limited
+func (s *Server) limitBytes(conn net.Conn) io.Reader {
+	if s.maxBytesPerConn <= 0 {
+		return conn
+	}
+	return &bytesLimitReader{r: conn, max: s.maxBytesPerConn}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+//This test shows connections over the per IP limit are rejected
+//and that closed connections free their slot.
+func TestMaxConnectionsPerIP(t *testing.T) {
+	const n = 3
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handling := make(chan struct{})
+	s := NewServer(WithMaxConnectionsPerIP(n), WithHandler(NoError(func(conn net.Conn, ctx context.Context) {
+		handling <- struct{}{}
+		io.Copy(io.Discard, conn) //until the client goes away
+	})))
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, context.Background())
+		close(finished)
+	}()
+
+	var conns []net.Conn
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-handling
+		conns = append(conns, conn)
+	}
+
+	rejected, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(rejected).ReadString('\n'); err != io.EOF {
+		t.Fatalf("Expected the connection over the limit to be closed but received '%v'", err)
+	}
+	rejected.Close()
+
+	//once a connection is closed, there's room for another one
+	conns[0].Close()
+	for s.ipConns("127.0.0.1") == n {
+		time.Sleep(time.Millisecond)
+	}
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-handling
+	conns[0] = conn
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	l.Close()
+	<-finished
+}
+
+//This test shows connections from IPs that aren't allowed are closed before they're handled,
+//and that the deny list takes precedence over the allow list.
+func TestIPAccessLists(t *testing.T) {
+	network := func(cidr string) net.IPNet {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *n
+	}
+	loopback, private := network("127.0.0.0/8"), network("10.0.0.0/8")
+	for _, tc := range []struct {
+		name        string
+		allow, deny []net.IPNet
+		header      string //the PROXY protocol header, if any
+		allowed     bool
+	}{
+		{name: "denied", deny: []net.IPNet{loopback}},
+		{name: "not allowed", allow: []net.IPNet{private}},
+		{name: "allowed", allow: []net.IPNet{private, loopback}, allowed: true},
+		{name: "allowed and denied", allow: []net.IPNet{loopback}, deny: []net.IPNet{network("127.0.0.1/32")}},
+		{name: "not denied", deny: []net.IPNet{private}, allowed: true},
+		{name: "denied behind a proxy", deny: []net.IPNet{private}, header: "PROXY TCP4 10.0.0.1 10.0.0.2 56324 443\r\n"},
+		{name: "allowed behind a proxy", deny: []net.IPNet{loopback}, header: "PROXY TCP4 192.168.0.1 10.0.0.2 56324 443\r\n", allowed: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handled := make(chan struct{}, 1)
+			a, _ := StartTest(t, WithIPAllowList(tc.allow), WithIPDenyList(tc.deny), WithProxyProtocol(tc.header != ""),
+				WithHandler(NoError(func(conn net.Conn, ctx context.Context) {
+					handled <- struct{}{}
+					conn.Write([]byte(message + "\n"))
+				})))
+			conn, err := net.Dial("tcp", a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte(tc.header))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if tc.allowed && line != message+"\n" {
+				t.Fatalf("Expected the connection to be handled but received '%s' (%v)", line, err)
+			}
+			if !tc.allowed && err != io.EOF {
+				t.Fatalf("Expected the connection to be closed but received '%s' (%v)", line, err)
+			}
+			if !tc.allowed && len(handled) != 0 {
+				t.Fatal("Expected the connection not to be handled")
+			}
+		})
+	}
+}
+
+func (s *Server) ipConns(ip string) int {
+	s.ipMu.Lock()
+	defer s.ipMu.Unlock()
+	return s.connsPerIP[ip]
+}
+
+//This test shows the token bucket allows bursts and then paces the messages to the rate.
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 2, now)
+	for i := 0; i < 2; i++ {
+		if wait := b.reserve(now); wait != 0 {
+			t.Fatalf("Expected the burst to pass but message %d waits %v", i, wait)
+		}
+	}
+	if wait := b.reserve(now); wait != 100*time.Millisecond {
+		t.Fatalf("Expected to wait %v but waits %v", 100*time.Millisecond, wait)
+	}
+	//the tokens are refilled over time
+	if wait := b.reserve(now.Add(time.Second)); wait != 0 {
+		t.Fatalf("Expected the bucket to refill but waits %v", wait)
+	}
+}
+
+//This test shows the handler paces a client that sends a burst over the rate limit.
+func TestMessageRateLimit(t *testing.T) {
+	const rate, burst, n = 50, 1, 6
+	cliConn, servConn := tcpPair(t)
+	s := NewServer(WithMessageRateLimit(rate, burst), WithPersister(&recordingPersister{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(cliConn, "%s %d\n", message, i)
+	}
+	r := bufio.NewReader(cliConn)
+	for i := 0; i < n; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//all but the burst wait for a token
+	if elapsed, expected := time.Since(start), time.Second*(n-burst)/rate; elapsed < expected {
+		t.Fatalf("Expected %d messages to take at least %v but they took %v", n, expected, elapsed)
+	}
+}
+
+//This test shows the handler closes a connection that keeps exceeding the rate limit.
+func TestMaxRateViolations(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	s := NewServer(WithMessageRateLimit(10, 1), WithMaxRateViolations(2), WithPersister(&recordingPersister{}))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.persistAndEcho(servConn, context.Background())
+	}()
+
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(cliConn, "%s %d\n", message, i)
+	}
+	select {
+	case err := <-errCh:
+		if err != ErrRateLimited {
+			t.Fatalf("Expected '%v' but received '%v'", ErrRateLimited, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connection to be closed")
+	}
+}
+
+//This test shows the handler closes a connection that sends more than the allowed bytes,
+//after handling the messages up to the limit.
+func TestMaxBytesPerConnection(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	p := &recordingPersister{}
+	line := message + "\n"
+	//two full lines and a bit of the third one
+	s := NewServer(WithMaxBytesPerConnection(int64(2*len(line)+1)), WithPersister(p))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.persistAndEcho(servConn, context.Background())
+	}()
+
+	go cliConn.Write([]byte(strings.Repeat(line, 10)))
+	select {
+	case err := <-errCh:
+		if err != ErrTooManyBytes {
+			t.Fatalf("Expected '%v' but received '%v'", ErrTooManyBytes, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connection to be closed")
+	}
+	if msgs := p.messages(); len(msgs) < 2 || msgs[0] != message || msgs[1] != message {
+		t.Fatalf("Expected the messages up to the limit to be persisted but received %v", msgs)
+	}
+}
+
+//This test shows a client that sends exactly the allowed bytes isn't cut off.
+func TestMaxBytesPerConnectionExact(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	line := message + "\n"
+	s := NewServer(WithMaxBytesPerConnection(int64(len(line))), WithPersister(&recordingPersister{}))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.persistAndEcho(servConn, context.Background())
+	}()
+
+	cliConn.Write([]byte(line))
+	if echo, err := bufio.NewReader(cliConn).ReadString('\n'); echo != line {
+		t.Fatalf("Expected '%s' but received '%s' (%v)", message, echo, err)
+	}
+	cliConn.(*net.TCPConn).CloseWrite()
+	if err := <-errCh; err != nil {
+		t.Fatalf("Expected no error but received '%v'", err)
+	}
+}
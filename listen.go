@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+//listen creates the listener for the server's network and addr.
+//Unix sockets are removed by the listener when it is closed,
+//but a server that crashed leaves its socket file behind
+//and listening on it again fails with "address already in use", so we remove it first
+func (s *Server) listen(addr string) (net.Listener, error) {
+	if s.network == "unix" {
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+	lc := net.ListenConfig{Control: s.listenControl}
+	return lc.Listen(context.Background(), s.network, addr)
+}
+
+//listenAll creates a listener for each of the server's addresses (see: WithListenAddr).
+//If any of them fails the others are closed.
+//Listeners given to the server (see: WithListener) are used as they are instead
+func (s *Server) listenAll() ([]net.Listener, error) {
+	if len(s.listeners) > 0 {
+		return append([]net.Listener(nil), s.listeners...), nil
+	}
+	var ls []net.Listener
+	for _, addr := range append([]string{s.addr}, s.extraAddrs...) {
+		l, err := s.listen(addr)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+//removeStaleSocket removes the socket file at path if nobody is listening on it anymore,
+//refusing to remove anything that isn't a socket or a socket that is still in use
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: address already in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
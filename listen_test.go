@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+//This test shows the server serves unix sockets,
+//removing a stale socket file before listening and the socket file after shutdown.
+func TestServerUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.sock")
+
+	//leave a socket file behind like a crashed server would
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	s := NewServer(WithNetwork("unix"), WithAddr(path))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	finished := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(finished)
+	}()
+	<-s.Ready()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(message + "\n"))
+	if echo, err := bufio.NewReader(conn).ReadString('\n'); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s' (%v)", message, echo, err)
+	}
+
+	cancel()
+	<-finished
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected the socket file to be removed but received '%v'", err)
+	}
+}
+
+//This test shows the server doesn't remove files that aren't sockets.
+func TestListenUnixNotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.sock")
+	if err := os.WriteFile(path, []byte("important"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer(WithNetwork("unix")).listen(path); err == nil {
+		t.Fatal("Expected listening on a regular file to fail")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the file to be left alone but received '%v'", err)
+	}
+}
+
+//This test shows the server doesn't take over the socket of a server that is still listening.
+func TestListenUnixInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, err := NewServer(WithNetwork("unix")).listen(path); err == nil {
+		t.Fatal("Expected listening on a socket in use to fail")
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Expected the first server to still be reachable but received '%v'", err)
+	}
+	conn.Close()
+}
+
+//This test shows Run serves a listener it was given instead of listening itself
+//and closes it when it stops.
+func TestServerWithListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(WithAddr("invalid address"), WithListener(l))
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(finished)
+	}()
+	<-s.Ready()
+	if s.Addr().String() != l.Addr().String() {
+		t.Fatalf("Expected '%v' but received '%v'", l.Addr(), s.Addr())
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(message + "\n"))
+	if echo, err := bufio.NewReader(conn).ReadString('\n'); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s' (%v)", message, echo, err)
+	}
+	conn.Close()
+	cancel()
+	<-finished
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Expected the listener to be closed but received '%v'", err)
+	}
+}
+
+//This test shows Run returns an error when the address is already in use instead of panicking.
+func TestRunAddressInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := NewServer(WithAddr(l.Addr().String())).Run(context.Background()); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("Expected '%v' but received '%v'", syscall.EADDRINUSE, err)
+	}
+}
+
+//This test shows a server bound to an IPv4 address only accepts connections on it,
+//and one bound with "tcp6" only on IPv6
+func TestListenOneInterface(t *testing.T) {
+	probe, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	probe.Close()
+
+	for _, tc := range []struct {
+		network, addr, other string
+	}{
+		{"tcp", "127.0.0.1:0", "::1"},
+		{"tcp6", "[::1]:0", "127.0.0.1"},
+	} {
+		t.Run(tc.network, func(t *testing.T) {
+			a, _ := StartTest(t, WithNetwork(tc.network), WithAddr(tc.addr))
+			conn, err := net.Dial("tcp", a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Write([]byte(message + "\n"))
+			mustReadLine(t, bufio.NewReader(conn))
+			conn.Close()
+
+			_, port, _ := net.SplitHostPort(a)
+			if conn, err := net.Dial("tcp", net.JoinHostPort(tc.other, port)); err == nil {
+				conn.Close()
+				t.Fatalf("Expected the connection from %s to be refused", tc.other)
+			}
+		})
+	}
+}
+
+//This test shows the server listens on the address from the environment, or on the fallback without it
+func TestAddrFromEnv(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := l.Addr().String()
+	l.Close()
+
+	t.Setenv("ECHO_ADDR", free)
+	if a, _ := StartTest(t, WithAddrFromEnv("ECHO_ADDR", addr)); a != free {
+		t.Fatalf("Expected the server to listen on %s but it listens on %s", free, a)
+	}
+	t.Setenv("ECHO_ADDR", "")
+	if a, _ := StartTest(t, WithAddrFromEnv("ECHO_ADDR", addr)); a == free {
+		t.Fatalf("Expected the server to listen on the fallback %s but it listens on %s", addr, a)
+	}
+}
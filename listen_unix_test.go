@@ -0,0 +1,45 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+//This test shows the listen control sets the socket options of the listener
+//so the server can be restarted on the same port right after it stopped.
+func TestListenControl(t *testing.T) {
+	var calls atomic.Int32
+	reuseAddr := func(network, address string, c syscall.RawConn) error {
+		calls.Add(1)
+		var err error
+		if ctrlErr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		}); ctrlErr != nil {
+			return ctrlErr
+		}
+		return err
+	}
+	a, stop := StartTest(t, WithListenControl(reuseAddr))
+	//leave a connection behind the server closes itself, in TIME_WAIT after the server stopped
+	conn, err := net.Dial("tcp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(message + "\n"))
+	mustReadLine(t, bufio.NewReader(conn))
+	stop()
+
+	a2, _ := StartTest(t, WithAddr(a), WithListenControl(reuseAddr))
+	if a2 != a {
+		t.Fatalf("Expected the server to listen on %s but it listens on %s", a, a2)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("Expected the control to be called twice but it was called %d times", n)
+	}
+}
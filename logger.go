@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+//loggerKey is the context key of the connection's logger,
+//Serve adds the connection's ID and remote address to the server's logger
+type loggerKey struct{}
+
+//connLogger returns the logger of the connection handled with ctx,
+//or the server's logger if ctx doesn't belong to a connection accepted by Serve
+func (s *Server) connLogger(ctx context.Context) *slog.Logger {
+	return ctxLogger(ctx, s.logger)
+}
+
+//ctxLogger returns the logger of the connection handled with ctx or fallback
+func ctxLogger(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return fallback
+}
+
+//minLevelHandler drops the records below min, see: WithAcceptLogSampling
+type minLevelHandler struct {
+	slog.Handler
+	min slog.Level
+}
+
+func (h *minLevelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.min && h.Handler.Enabled(ctx, level)
+}
+
+func (h *minLevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &minLevelHandler{Handler: h.Handler.WithAttrs(attrs), min: h.min}
+}
+
+func (h *minLevelHandler) WithGroup(name string) slog.Handler {
+	return &minLevelHandler{Handler: h.Handler.WithGroup(name), min: h.min}
+}
+
+//sampleLogger returns the logger of the connection with the given ID.
+//Only 1 of every n connections logs everything (see: WithAcceptLogSampling),
+//the others only log their warnings and errors
+func (s *Server) sampleLogger(logger *slog.Logger, id uint64) *slog.Logger {
+	if n := s.acceptLogSampling; n <= 1 || (id-1)%n == 0 {
+		return logger
+	}
+	return slog.New(&minLevelHandler{Handler: logger.Handler(), min: slog.LevelWarn})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+//This test shows only 1 of every n connections logs its accept,
+//while the errors of the other connections are still logged
+func TestAcceptLogSampling(t *testing.T) {
+	var logs syncBuffer
+	a, stop := StartTest(t, WithAcceptLogSampling(5), WithMaxLineSize(16), WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	defer stop()
+	for i := 0; i < 10; i++ {
+		conn, err := net.Dial("tcp", a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(message + "\n"))
+		mustReadLine(t, bufio.NewReader(conn))
+		conn.Close()
+	}
+	if n := strings.Count(logs.String(), "Accepted connection"); n != 2 {
+		t.Fatalf("Expected 2 accept logs for 10 connections but received %d:\n%s", n, logs.String())
+	}
+
+	//connection 12 isn't sampled
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(strings.Repeat("a", 32) + "\n"))
+		io.Copy(io.Discard, conn) //until the server closes it
+		conn.Close()
+	}
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "Line exceeds") && strings.Contains(line, "conn=12") {
+			return
+		}
+	}
+	t.Fatalf("Expected the error of connection 12 to be logged but received:\n%s", logs.String())
+}
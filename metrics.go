@@ -0,0 +1,22 @@
+package main
+
+//Metrics is notified about the connections and messages handled by the server,
+//so it can be backed by Prometheus or any other metrics library
+//without the server depending on it. It is called concurrently
+type Metrics interface {
+	//IncConnections and DecConnections are called when a connection's handling starts and ends
+	IncConnections()
+	DecConnections()
+	//ObserveMessageBytes is called with the size of every message received
+	ObserveMessageBytes(n int)
+	//IncErrors is called for every failed handshake, handler, message persistence, etc.
+	IncErrors()
+}
+
+//noMetrics is the default Metrics, it does nothing
+type noMetrics struct{}
+
+func (noMetrics) IncConnections()           {}
+func (noMetrics) DecConnections()           {}
+func (noMetrics) ObserveMessageBytes(n int) {}
+func (noMetrics) IncErrors()                {}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+type countingMetrics struct {
+	connections  atomic.Int64
+	messages     atomic.Int64
+	messageBytes atomic.Int64
+	errors       atomic.Int64
+}
+
+func (m *countingMetrics) IncConnections() { m.connections.Add(1) }
+func (m *countingMetrics) DecConnections() { m.connections.Add(-1) }
+func (m *countingMetrics) ObserveMessageBytes(n int) {
+	m.messages.Add(1)
+	m.messageBytes.Add(int64(n))
+}
+func (m *countingMetrics) IncErrors() { m.errors.Add(1) }
+
+//This test shows the metrics follow the connections and messages.
+func TestMetrics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &countingMetrics{}
+	mCh := make(chan []byte, 1)
+	s := NewServer(WithMetrics(m), WithMessageChannel(mCh))
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, context.Background())
+		close(finished)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(message + "\n"))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.connections.Load(); n != 1 {
+		t.Fatalf("Expected 1 connection but received %d", n)
+	}
+	if n := m.messages.Load(); n != 1 {
+		t.Fatalf("Expected 1 message but received %d", n)
+	}
+	if n := m.messageBytes.Load(); n != int64(len(message)) {
+		t.Fatalf("Expected %d message bytes but received %d", len(message), n)
+	}
+
+	conn.Close()
+	l.Close()
+	<-finished
+	if n := m.connections.Load(); n != 0 {
+		t.Fatalf("Expected no connections but received %d", n)
+	}
+	if n := m.errors.Load(); n != 0 {
+		t.Fatalf("Expected no errors but received %d", n)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+)
+
+//Middleware wraps a Handler with behavior shared by all the connections, e.g. logging or auth
+type Middleware func(next Handler) Handler
+
+//Chain wraps h with mw, the first middleware is the outermost,
+//i.e. Chain(h, a, b) handles a connection with a(b(h))
+func Chain(h Handler, mw ...Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+//LogConnections is a Middleware that logs when the handling of every connection starts and ends
+func LogConnections(next Handler) Handler {
+	return func(conn net.Conn, ctx context.Context) error {
+		logger := ctxLogger(ctx, slog.Default())
+		start := time.Now()
+		logger.Info("Connection handler started")
+		err := next(conn, ctx)
+		logger.Info("Connection handler finished", "duration", time.Since(start), "err", err)
+		return err
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+//This test shows the middleware runs in the declared order around the handler.
+func TestMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	record := func(call string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, call)
+	}
+	named := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(conn net.Conn, ctx context.Context) error {
+				record(name + " before")
+				err := next(conn, ctx)
+				record(name + " after")
+				return err
+			}
+		}
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	s := NewServer(
+		WithHandler(NoError(func(conn net.Conn, ctx context.Context) {
+			record("handler")
+		})),
+		//closes done once all the others are done
+		WithMiddleware(func(next Handler) Handler {
+			return func(conn net.Conn, ctx context.Context) error {
+				defer close(done)
+				return next(conn, ctx)
+			}
+		}),
+		WithMiddleware(named("outer"), LogConnections),
+		WithMiddleware(named("inner")),
+	)
+	go s.Serve(l, context.Background())
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	conn.Close()
+	l.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"outer before", "inner before", "handler", "inner after", "outer after"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("Expected %v but received %v", expected, calls)
+	}
+}
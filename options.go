@@ -0,0 +1,668 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+//Option configures a Server, see: NewServer
+type Option func(s *Server)
+
+//WithNetwork sets the network the server listens on (default "tcp"), see: net.Listen
+//"tcp" listens on both IPv4 and IPv6 when the address allows it, "tcp4" and "tcp6" on one of them only
+//With "unix" the address is the path of the socket file
+//With "udp" (or "unixgram") the server serves datagrams instead of connections, see: ServePacket
+func WithNetwork(network string) Option {
+	return func(s *Server) {
+		s.network = network
+	}
+}
+
+//WithAddr sets the address the server listens on (default ":9090")
+//":9090" listens on all the interfaces, an IP like "192.0.2.1:9090" or "[::1]:9090" only on the interface that has it.
+//The socket options, e.g. IPV6_V6ONLY for a dual stack address, can be set with WithListenControl
+func WithAddr(addr string) Option {
+	return func(s *Server) {
+		s.addr = addr
+	}
+}
+
+//WithAddrFromEnv sets the address the server listens on to the value of the environment variable key, e.g. "ADDR",
+//or to fallback if it isn't set (or is empty). The variable is read by NewServer
+func WithAddrFromEnv(key, fallback string) Option {
+	return func(s *Server) {
+		s.addr = fallback
+		if addr := os.Getenv(key); addr != "" {
+			s.addr = addr
+		}
+	}
+}
+
+//WithListenAddr adds an address the server listens on besides its address (see: WithAddr),
+//e.g. a localhost only port next to the public one.
+//All the addresses are served the same way and share the messages channel
+func WithListenAddr(addr string) Option {
+	return func(s *Server) {
+		s.extraAddrs = append(s.extraAddrs, addr)
+	}
+}
+
+//WithListener makes Run serve l instead of listening on the server's addresses,
+//e.g. a listener inherited from systemd (see: ListenersFromSystemd).
+//It may be used several times to serve several listeners. Run closes them when it stops
+func WithListener(l net.Listener) Option {
+	return func(s *Server) {
+		s.listeners = append(s.listeners, l)
+	}
+}
+
+//WithListenControl calls control with every socket the server listens on before it's bound,
+//to set socket options like SO_REUSEADDR or SO_REUSEPORT (see: net.ListenConfig).
+//It has no effect on the listeners given to the server with WithListener
+func WithListenControl(control func(network, address string, c syscall.RawConn) error) Option {
+	return func(s *Server) {
+		s.listenControl = control
+	}
+}
+
+//WithAdminAddr makes Run listen on addr for admin connections, e.g. "127.0.0.1:9090".
+//A "DEBUG" line is answered with the number of connections, messages and goroutines,
+//a "name value" line each followed by an empty line.
+//The admin listener stays open until Run returns, so it helps when the termination hangs.
+//Keep it away from the clients
+func WithAdminAddr(addr string) Option {
+	return func(s *Server) {
+		s.admin = addr
+	}
+}
+
+//WithFlushInterval makes the default handler batch its echoes for up to d before writing them,
+//instead of writing every echo right away (on its own, in a single write).
+//It saves syscalls when clients send many messages, at the cost of delaying the echoes.
+//Echoes written directly to the connection by custom handlers aren't batched
+func WithFlushInterval(d time.Duration) Option {
+	return func(s *Server) {
+		s.flushInterval = d
+	}
+}
+
+//WithHandler replaces the default PersistAndEcho connection handler
+func WithHandler(handler Handler) Option {
+	return func(s *Server) {
+		s.handler = handler
+	}
+}
+
+//WithMiddleware wraps the connection handler with mw, see: Chain.
+//It may be used several times, the middleware is applied in order, outermost first
+func WithMiddleware(mw ...Middleware) Option {
+	return func(s *Server) {
+		s.middleware = append(s.middleware, mw...)
+	}
+}
+
+//WithMessageChannel makes the default handler write the messages to mCh.
+//The caller is responsible for draining mCh,
+//the server closes it once all the connections were handled.
+func WithMessageChannel(mCh chan []byte) Option {
+	return func(s *Server) {
+		s.mCh = mCh
+		s.ownsMCh = false
+	}
+}
+
+//WithMessageBufferSize makes the server's own mCh a buffered channel of size n (default unbuffered).
+//Handlers only block on persisting a message once n messages are waiting for the consumers,
+//which slows down the clients (backpressure) instead of using more memory.
+//It has no effect together with WithMessageChannel
+func WithMessageBufferSize(n int) Option {
+	return func(s *Server) {
+		s.mChSize = n
+	}
+}
+
+//WithDropOnFull makes the server's own mCh a buffered channel of size n
+//and drops the messages that don't fit instead of waiting for the consumers.
+//It's the opposite of the backpressure of WithMessageBufferSize: the clients never slow down but messages are lost,
+//see: DroppedMessages. It's WithMessageBufferSize(n) and WithBackpressure(DropNewest{})
+func WithDropOnFull(n int) Option {
+	return func(s *Server) {
+		s.mChSize = n
+		s.backpressure = DropNewest{}
+	}
+}
+
+//WithBackpressure sets what the default handler does with a message when mCh is full (default Block{}),
+//e.g. DropOldest{} to keep the latest messages. See: DroppedMessages.
+//mCh is unbuffered unless WithMessageBufferSize is used, then it's "full" whenever no consumer is waiting.
+//It has no effect together with WithPersister
+func WithBackpressure(strategy Strategy) Option {
+	return func(s *Server) {
+		s.backpressure = strategy
+	}
+}
+
+//WithMessageConsumer sets the function the server's own mCh is drained with,
+//instead of printing every message.
+//It's called by a single goroutine in the order the messages were persisted, unless WithConsumerWorkers is used
+func WithMessageConsumer(consume func(msg []byte)) Option {
+	return func(s *Server) {
+		s.consume = consume
+	}
+}
+
+//WithConsumerWorkers sets the number of goroutines draining the server's own mCh (default 1).
+//With more than one consumer messages may be consumed out of order
+func WithConsumerWorkers(n int) Option {
+	return func(s *Server) {
+		if n < 1 {
+			n = 1
+		}
+		s.consumers = n
+	}
+}
+
+//withReady makes the server close ready instead of its own channel once it is listening
+//used by the package level Run
+func withReady(ready chan struct{}) Option {
+	return func(s *Server) {
+		s.ready = ready
+	}
+}
+
+//WithOnReady sets a function Run calls with the address it listens on
+//as soon as it is listening, before Ready is closed
+func WithOnReady(onReady func(addr net.Addr)) Option {
+	return func(s *Server) {
+		s.onReady = onReady
+	}
+}
+
+//WithEcho sets whether the default handler echoes the messages back to the clients (default true).
+//Without echoes the server only persists the messages,
+//so fire-and-forget clients that never read can't block it
+func WithEcho(echo bool) Option {
+	return func(s *Server) {
+		s.echoes = echo
+	}
+}
+
+//WithSequencedEcho prefixes every echo with its number on the connection, starting at 1,
+//e.g. "1 sup?", so clients can detect dropped or reordered echoes
+func WithSequencedEcho(sequenced bool) Option {
+	return func(s *Server) {
+		s.sequencedEcho = sequenced
+	}
+}
+
+//WithEchoTransform makes the default handler echo transform(msg) instead of msg, e.g. bytes.ToUpper.
+//The message is persisted as it was received, transform gets a copy it may modify.
+//Sequence numbers (see: WithSequencedEcho) are added to the transformed echo
+func WithEchoTransform(transform func(msg []byte) []byte) Option {
+	return func(s *Server) {
+		s.echoTransform = transform
+	}
+}
+
+//WithJSONValidation makes the default handler only accept messages that are valid JSON, e.g. one object per line.
+//Invalid messages aren't persisted and are answered with "ERR invalid json" instead of their echo,
+//framed like the echoes (e.g. "ERR invalid json\n" by default)
+func WithJSONValidation(validate bool) Option {
+	return func(s *Server) {
+		s.validateJSON = validate
+	}
+}
+
+//WithStrictProtocol makes the default handler close a connection on its first invalid message (see: WithJSONValidation),
+//after answering it, instead of carrying on with the next one. Messages that are too long always close the connection
+func WithStrictProtocol(strict bool) Option {
+	return func(s *Server) {
+		s.strictProtocol = strict
+	}
+}
+
+//WithMessageHook makes the default handler call hook with every message before persisting and echoing it.
+//The message is only persisted if hook returns persist and only echoed if it returns echo (and echoes are enabled, see: WithEcho).
+//If hook returns an error the connection is closed instead, e.g. to get rid of spammers (see: RejectConnection).
+//It's called after the rate limit and must not modify msg
+func WithMessageHook(hook func(ctx context.Context, msg []byte) (persist, echo bool, err error)) Option {
+	return func(s *Server) {
+		s.messageHook = hook
+	}
+}
+
+//WithBufferPool sets whether the default handler takes its initial read buffer from a pool shared by the connections (default true),
+//rather than allocating one per connection. Only one connection uses a buffer at a time,
+//the buffers that grew for long messages aren't kept
+func WithBufferPool(pool bool) Option {
+	return func(s *Server) {
+		s.poolBuffers = pool
+	}
+}
+
+//WithHalfCloseOnShutdown makes the server half close the TCP connections it's done with (CloseWrite), after flushing the echoes.
+//The client reads an EOF and the connection is fully closed once the client closes its end
+//or after a second at most, whatever the client sends meanwhile is dropped
+func WithHalfCloseOnShutdown(halfClose bool) Option {
+	return func(s *Server) {
+		s.halfClose = halfClose
+	}
+}
+
+//WithDedup makes the default handler persist a message only once per connection within window.
+//Duplicates are still echoed, so clients that retransmit get their answer, see: DedupedMessages.
+//Each connection remembers its last few dozen persisted messages, a message that failed to persist may be retransmitted
+func WithDedup(window time.Duration) Option {
+	return func(s *Server) {
+		s.dedupWindow = window
+	}
+}
+
+//WithTrimMessage makes the default handler remove the trailing characters in cutset from every message
+//before handling it, e.g. " \t\r" for the stray whitespace of telnet clients.
+//The trimmed message is also what's echoed. By default (or with an empty cutset) messages aren't trimmed
+func WithTrimMessage(cutset string) Option {
+	return func(s *Server) {
+		s.trimCutset = cutset
+	}
+}
+
+//WithPersistUnterminated makes the default handler persist and echo what the client sent of its last message
+//when the connection is interrupted (e.g. when Run's context is cancelled), even though it wasn't terminated.
+//A client closing the connection always terminates its last message.
+//The message is persisted with the interrupted context, so only a persister that doesn't have to wait gets it
+func WithPersistUnterminated(persist bool) Option {
+	return func(s *Server) {
+		s.persistUnterminated = persist
+	}
+}
+
+//WithPingResponder makes the default handler answer request messages with response,
+//without persisting them, so health checks can use the same port.
+//By default "PING" is answered with "PONG", a nil request disables the responder
+func WithPingResponder(request, response []byte) Option {
+	return func(s *Server) {
+		s.pingRequest = request
+		s.pingResponse = response
+	}
+}
+
+//WithQuitCommand makes the default handler close the connection when the client sends cmd, without persisting it.
+//The client gets farewell (framed like an echo) first unless it's nil. This isn't an error, see: CloseQuit.
+//By default "QUIT" closes the connection without a farewell, a nil cmd disables the command
+func WithQuitCommand(cmd, farewell []byte) Option {
+	return func(s *Server) {
+		s.quitCommand = cmd
+		s.farewell = farewell
+	}
+}
+
+//WithMaxLineSize sets the maximum size of a single line (message) in bytes.
+//By default lines are limited to bufio.MaxScanTokenSize (64KB),
+//longer lines terminate the connection with bufio.ErrTooLong.
+//The terminator (or length header) doesn't count, except with custom framers
+func WithMaxLineSize(n int) Option {
+	return func(s *Server) {
+		s.limits.MaxMessageSize = n
+	}
+}
+
+//defaultTooLargeResponse is the response to messages over the maximum size, see: WithMaxMessageSize
+var defaultTooLargeResponse = []byte("ERR message too large")
+
+//WithMaxMessageSize is WithMaxLineSize, but instead of just closing the connection
+//when a message is too large the client is told why first, with "ERR message too large"
+//(framed like the echoes, e.g. "ERR message too large\n" by default) unless WithTooLargeResponse is used
+func WithMaxMessageSize(n int) Option {
+	return func(s *Server) {
+		s.limits.MaxMessageSize = n
+		if s.tooLargeResponse == nil {
+			s.tooLargeResponse = defaultTooLargeResponse
+		}
+	}
+}
+
+//WithTooLargeResponse sets the response framed like an echo to clients that send a message over the maximum size,
+//before their connection is closed. By default (with WithMaxLineSize) nothing is written
+func WithTooLargeResponse(resp []byte) Option {
+	return func(s *Server) {
+		s.tooLargeResponse = resp
+	}
+}
+
+//WithBanner makes the default handler greet every client with banner, written as it is once the connection is accepted,
+//e.g. "220 echo ready\r\n" like SMTP. Clients that go away before getting it are closed quietly.
+//With WithWebSocket it's only written once the client sent something, until then it may still be a WebSocket
+func WithBanner(banner []byte) Option {
+	return func(s *Server) {
+		s.banner = banner
+	}
+}
+
+//WithRunDuration makes Run stop on its own after d, e.g. for a data collection job that runs for a fixed window.
+//It's a deadline on Run's context: the connections are interrupted when it passes,
+//and the messages that were received are still consumed before Run returns
+func WithRunDuration(d time.Duration) Option {
+	return func(s *Server) {
+		s.runDuration = d
+	}
+}
+
+//WithShutdownTimeout sets how long Run waits for the connections once it's terminating (default 30s),
+//whether its context was cancelled or the server is stopped. After Shutdown it only starts once the grace period
+//of Shutdown's context is over, a longer grace period isn't cut short.
+//After that it closes the remaining connections and returns ErrShutdownTimeout without waiting for their handlers,
+//so a stuck handler can't keep the process from exiting. Zero waits forever
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.shutdownTimeout = d
+	}
+}
+
+//WithWriteTimeout bounds the time an echo write may block on a client that doesn't read.
+//A timed out connection is closed. By default writes have no deadline
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+//WithIdleTimeout closes connections that don't send a message for longer than d.
+//By default connections may stay idle until the server shuts down
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+//WithWebSocket makes the server accept WebSocket clients (e.g. browsers) on the same port as the other clients.
+//A connection that starts with "GET " is expected to be a WebSocket handshake,
+//and every text message is a message of the default handler, echoed as a text message.
+//Other connections are handled as usual, their first message just can't start with "GET "
+func WithWebSocket(enabled bool) Option {
+	return func(s *Server) {
+		s.webSocket = enabled
+	}
+}
+
+//WithFirstByteTimeout closes connections that don't send their first byte within d of being accepted,
+//so clients that connect and never send anything (slow loris) don't hold on to a connection slot.
+//Until the first byte it replaces the idle timeout (see: WithIdleTimeout)
+func WithFirstByteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.firstByteTimeout = d
+	}
+}
+
+//WithAcceptTimeout makes Serve wait at most d for every connection before checking its context,
+//so cancelling the context stops it even if the listener isn't closed.
+//It only works with listeners that have an accept deadline, like *net.TCPListener
+func WithAcceptTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.acceptTimeout = d
+	}
+}
+
+//WithMaxAcceptBackoff caps the delay between retries of temporary accept errors, e.g. running out of file descriptors (default 1s).
+//The delay doubles from 5ms with every error, with some jitter, and starts over once a connection is accepted
+func WithMaxAcceptBackoff(d time.Duration) Option {
+	return func(s *Server) {
+		s.maxAcceptBackoff = d
+	}
+}
+
+//WithConnectionTimeout limits the lifetime of every connection to d, active or not.
+//Once d elapses its handler is interrupted and the connection is closed
+func WithConnectionTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.connTimeout = d
+	}
+}
+
+//WithKeepAlive enables TCP keep-alives every period on the accepted connections,
+//so the server notices dead clients that never closed their connection.
+//By default the operating system's (or Go's) default applies
+func WithKeepAlive(period time.Duration) Option {
+	return func(s *Server) {
+		s.keepAlive = period
+	}
+}
+
+//WithMaxConnections limits the number of connections handled concurrently to n (0 is unlimited).
+//Once the limit is reached new connections wait for a free slot,
+//unless WithRejectOnFull is used
+func WithMaxConnections(n int) Option {
+	return func(s *Server) {
+		s.connSlots = nil
+		if n > 0 {
+			s.connSlots = make(chan struct{}, n)
+		}
+	}
+}
+
+//WithRejectOnFull makes the server close new connections immediately
+//instead of waiting when the WithMaxConnections limit is reached
+func WithRejectOnFull(reject bool) Option {
+	return func(s *Server) {
+		s.rejectOnFull = reject
+	}
+}
+
+//WithPersister makes the default handler persist messages with p instead of sending them to mCh
+func WithPersister(p Persister) Option {
+	return func(s *Server) {
+		s.persister = p
+	}
+}
+
+//WithForwardTo makes the default handler (and ServePacket) forward every persisted message to the TCP server at addr as well,
+//framed like the echoes. The connection is dialed with dialTimeout and redialed when it fails.
+//Forwarding never blocks the handlers, failures are logged and retried
+//and messages are dropped if the upstream can't keep up.
+//The forwarder runs while the server is serving: it stops with the last Serve (or ServePacket) call, e.g. when Run returns,
+//and handlers that run without Serve (see: PersistAndEcho) leave it running until the process exits
+func WithForwardTo(addr string, dialTimeout time.Duration) Option {
+	return func(s *Server) {
+		s.forwarder = &forwarder{addr: addr, dialTimeout: dialTimeout, queue: make(chan []byte, forwardQueueSize)}
+	}
+}
+
+//WithCloseOnPersistError makes the default handler close the connection when persisting a message fails.
+//By default the failure is logged and the connection is kept open
+func WithCloseOnPersistError(close bool) Option {
+	return func(s *Server) {
+		s.closeOnPersistError = close
+	}
+}
+
+//WithTLSConfig makes the server accept TLS connections only, using config.
+//With ClientAuth set to tls.RequireAndVerifyClientCert only clients with a certificate signed by ClientCAs are accepted,
+//and their certificate's Common Name identifies them, see: ClientIdentity
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+//WithVirtualServices serves several services on one TLS port (see: WithTLSConfig), by the server name clients ask for (SNI).
+//Connections to a name in services are handled with its persister and handler, the others with the server's.
+//The certificate for every name comes from the TLS config as usual, e.g. from its Certificates or GetCertificate
+func WithVirtualServices(services map[string]VirtualService) Option {
+	return func(s *Server) {
+		s.services = services
+	}
+}
+
+//WithPanicHandler sets the function called when a connection handler panics,
+//instead of logging the panic. The connection is closed after it returns
+func WithPanicHandler(handle func(conn net.Conn, v interface{})) Option {
+	return func(s *Server) {
+		s.panicHandler = handle
+	}
+}
+
+//WithLogger sets the logger of the server (default slog.Default()).
+//Connection logs carry the connection's "conn" ID and "remote" address
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+//WithAcceptLogSampling makes only 1 of every n connections log at the info level, e.g. when they're accepted and closed,
+//so the logs don't drown under load. Warnings and errors are always logged, with the connection's ID and address
+func WithAcceptLogSampling(n int) Option {
+	return func(s *Server) {
+		s.acceptLogSampling = uint64(max(n, 1))
+	}
+}
+
+//WithMetrics reports the server's metrics to m (nil disables metrics, the default)
+func WithMetrics(m Metrics) Option {
+	return func(s *Server) {
+		if m == nil {
+			m = noMetrics{}
+		}
+		s.metrics = m
+	}
+}
+
+//WithLineTerminator sets the terminator of the lines (messages) read from the clients
+//and written after every echo, e.g. "\r\n" for telnet-style clients.
+//By default (or with an empty terminator) lines end with "\n", optionally preceded by a "\r" which is dropped
+func WithLineTerminator(terminator []byte) Option {
+	return WithFraming(LineFramer{Terminator: terminator})
+}
+
+//WithDelimiter makes the messages read from the clients end with delim instead of a newline, e.g. 0 for NUL-delimited messages.
+//The echoes end with delim too. It's WithLineTerminator([]byte{delim})
+func WithDelimiter(delim byte) Option {
+	return WithLineTerminator([]byte{delim})
+}
+
+//WithSplitFunc sets how the messages are split from the stream read from the clients, see: bufio.Scanner.
+//The echoes are still framed as before, so give it after WithLineTerminator or WithFraming
+//to make the echoes end with the same delimiter
+func WithSplitFunc(split bufio.SplitFunc) Option {
+	return func(s *Server) {
+		s.framer = splitFramer{split: split, Framer: s.framer}
+	}
+}
+
+//WithFraming sets how messages are read from the clients and how the echoes are written,
+//e.g. LengthPrefixedFramer for binary messages. The default is LineFramer
+func WithFraming(framer Framer) Option {
+	return func(s *Server) {
+		s.framer = framer
+	}
+}
+
+//WithIPAllowList only accepts connections from clients whose IP is in one of the networks.
+//Other connections are closed right after they're accepted.
+//With the PROXY protocol (see: WithProxyProtocol) it's the IP from the header
+func WithIPAllowList(networks []net.IPNet) Option {
+	return func(s *Server) {
+		s.allowList = networks
+	}
+}
+
+//WithIPDenyList closes the connections from clients whose IP is in one of the networks right after they're accepted,
+//even if it's also in the allow list (see: WithIPAllowList)
+func WithIPDenyList(networks []net.IPNet) Option {
+	return func(s *Server) {
+		s.denyList = networks
+	}
+}
+
+//WithMaxConnectionsPerIP limits the number of concurrent connections from a single IP to n (0 is unlimited).
+//Connections over the limit are closed immediately
+func WithMaxConnectionsPerIP(n int) Option {
+	return func(s *Server) {
+		s.maxConnsPerIP = n
+	}
+}
+
+//WithMessageRateLimit limits every connection to rate messages per second, with bursts of up to burst messages.
+//The default handler waits before handling messages over the limit, see: WithMaxRateViolations
+func WithMessageRateLimit(rate float64, burst int) Option {
+	return func(s *Server) {
+		s.limits.MessageRate = rate
+		s.limits.MessageBurst = burst
+	}
+}
+
+//WithReloadOnSIGHUP makes Run replace the limits with the ones returned by load whenever the process receives SIGHUP,
+//e.g. after reading them from a configuration file, without dropping any connection (see: SetLimits).
+//If load fails the limits stay as they are
+func WithReloadOnSIGHUP(load func() (Limits, error)) Option {
+	return func(s *Server) {
+		s.reload = load
+	}
+}
+
+//WithMaxRateViolations makes the default handler close connections
+//once n of their messages exceeded the rate limit, instead of just slowing them down
+func WithMaxRateViolations(n int) Option {
+	return func(s *Server) {
+		s.maxRateViolations = n
+	}
+}
+
+//WithMaxBytesPerConnection makes the default handler close connections
+//that send more than n bytes altogether, with ErrTooManyBytes.
+//The messages received up to the limit are persisted and echoed as usual
+func WithMaxBytesPerConnection(n int64) Option {
+	return func(s *Server) {
+		s.maxBytesPerConn = n
+	}
+}
+
+//WithByteCounters counts the bytes every connection reads and writes, see: ConnBytes.
+//The totals are logged when the connection is closed.
+//The handlers receive a wrapper of the accepted connection instead of the connection itself
+func WithByteCounters(count bool) Option {
+	return func(s *Server) {
+		s.countBytes = count
+	}
+}
+
+//WithProxyProtocol makes the server expect a PROXY protocol v1 header at the start of every connection,
+//as sent by load balancers like HAProxy, and use the client's address from it
+//(see: RemoteAddr) for the logs and the per IP limits.
+//Connections with a missing or invalid header are closed
+func WithProxyProtocol(proxy bool) Option {
+	return func(s *Server) {
+		s.proxyProtocol = proxy
+	}
+}
+
+//WithConnState sets a function called when a connection changes state, see: ConnState.
+//It's called from the connection's goroutine, so it must be safe for concurrent use
+func WithConnState(hook func(conn net.Conn, state ConnState)) Option {
+	return func(s *Server) {
+		s.connState = hook
+	}
+}
+
+//WithCloseHook sets a function called with the final ConnInfo of every connection Serve closes,
+//e.g. to chart why connections drop (see: CloseReason). It's called after the StateClosed ConnState
+func WithCloseHook(hook func(info ConnInfo)) Option {
+	return func(s *Server) {
+		s.closeHook = hook
+	}
+}
+
+//WithCompression sets how the clients compress their messages and how the echoes are compressed (default CompressionNone).
+//With CompressionGzip every client sends a gzip stream and receives one, flushed after every echo.
+//The handlers receive a wrapper of the accepted connection instead of the connection itself
+func WithCompression(c Compression) Option {
+	return func(s *Server) {
+		s.compression = c
+	}
+}
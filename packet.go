@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+//maxDatagramSize is the largest UDP payload
+const maxDatagramSize = 65535
+
+//isPacketNetwork reports whether network is datagram oriented, see: ServePacket
+func isPacketNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+	return false
+}
+
+//listenPacket creates the packet connection for the server's network and addr
+func (s *Server) listenPacket(addr string) (net.PacketConn, error) {
+	if s.network == "unixgram" {
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+	lc := net.ListenConfig{Control: s.listenControl}
+	return lc.ListenPacket(context.Background(), s.network, addr)
+}
+
+//ServePacket reads datagrams from pc and persists and echoes each one back to its sender (see: WithEcho)
+//until pc is closed or ctx is cancelled.
+//Unlike Serve there are no connections and no goroutine per client:
+//every datagram is a message of its own, handled one at a time in the order it arrived,
+//so the handler, the framing and the connection limits don't apply.
+//Like Serve it returns nil if the server closed pc itself (see: Run and Shutdown)
+func (s *Server) ServePacket(pc net.PacketConn, ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sv := s.startServing(pc, cancel)
+	defer s.stopServing(sv)
+	go func() {
+		<-ctx.Done()
+		//same cheat as persistAndEcho, interrupts the blocked ReadFrom
+		interruptRead(pc)
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || s.closing.Load() {
+				return nil
+			}
+			return err
+		}
+		logger := s.logger.With("remote", from.String())
+		//buf is overwritten by the next datagram
+		msg := append([]byte(nil), buf[:n]...)
+		s.metrics.ObserveMessageBytes(len(msg))
+		if err := s.persister.Persist(ctx, msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			logger.Error("Persisting datagram failed", "err", err)
+			s.metrics.IncErrors()
+			continue
+		}
+		s.forward(msg)
+		if !s.echoes {
+			//persist only, e.g. fire and forget telemetry
+			continue
+		}
+		if s.writeTimeout > 0 {
+			pc.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		}
+		if _, err := pc.WriteTo(msg, from); err != nil {
+			logger.Warn("Echoing datagram failed", "err", err)
+			s.metrics.IncErrors()
+		}
+	}
+}
+
+//listenAllPacket creates a packet connection for each of the server's addresses.
+//If any of them fails the others are closed
+func (s *Server) listenAllPacket() ([]net.PacketConn, error) {
+	var pcs []net.PacketConn
+	for _, addr := range append([]string{s.addr}, s.extraAddrs...) {
+		pc, err := s.listenPacket(addr)
+		if err != nil {
+			for _, pc := range pcs {
+				pc.Close()
+			}
+			return nil, err
+		}
+		pcs = append(pcs, &onceClosePacketConn{PacketConn: pc})
+	}
+	return pcs, nil
+}
+
+//onceClosePacketConn ignores all but the first Close, see: onceCloseListener
+type onceClosePacketConn struct {
+	net.PacketConn
+	once sync.Once
+}
+
+func (pc *onceClosePacketConn) Close() (err error) {
+	pc.once.Do(func() {
+		err = pc.PacketConn.Close()
+	})
+	return err
+}
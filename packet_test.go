@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+//This test shows a UDP server persists every datagram and echoes it back to its sender.
+func TestServerUDP(t *testing.T) {
+	mCh := make(chan []byte, 1)
+	s := NewServer(WithNetwork("udp"), WithAddr(addr), WithMessageChannel(mCh))
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(finished)
+	}()
+	<-s.Ready()
+
+	conn, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxDatagramSize)
+	n, err := conn.Read(buf)
+	if string(buf[:n]) != message {
+		t.Fatalf("Expected '%s' but received '%s' (%v)", message, buf[:n], err)
+	}
+	if m := <-mCh; string(m) != message {
+		t.Fatalf("Expected '%s' to be persisted but received '%s'", message, m)
+	}
+
+	cancel()
+	<-finished
+	if _, ok := <-mCh; ok {
+		t.Fatal("Expected mCh to be closed")
+	}
+}
+
+//This test shows Shutdown stops ServePacket.
+func TestServePacketShutdown(t *testing.T) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.ServePacket(pc, context.Background())
+	}()
+	//make sure ServePacket is registered before shutting down
+	for {
+		s.mu.Lock()
+		n := len(s.serving)
+		s.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serveErr; err != nil {
+		t.Fatalf("Expected no error but received '%v'", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+//PartitionedConsumer is a Persister that consumes the messages with n workers,
+//partitioned by connection ID (see: ConnID).
+//Messages of different connections are consumed in parallel,
+//while the messages of a connection are consumed by the same worker, in order
+type PartitionedConsumer struct {
+	partitions []chan partitioned
+	wg         sync.WaitGroup
+}
+
+type partitioned struct {
+	id  uint64
+	msg []byte
+}
+
+//NewPartitionedConsumer starts n workers calling consume with every message and the ID of its connection.
+//Close stops them, after the server is done with the consumer
+func NewPartitionedConsumer(n int, consume func(id uint64, msg []byte)) *PartitionedConsumer {
+	if n < 1 {
+		n = 1
+	}
+	c := &PartitionedConsumer{partitions: make([]chan partitioned, n)}
+	for i := range c.partitions {
+		ch := make(chan partitioned)
+		c.partitions[i] = ch
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			for m := range ch {
+				consume(m.id, m.msg)
+			}
+		}()
+	}
+	return c
+}
+
+//Persist hands msg to the worker of its connection, messages without a connection ID go to the first worker
+func (c *PartitionedConsumer) Persist(ctx context.Context, msg []byte) error {
+	id, _ := ConnID(ctx)
+	select {
+	case c.partitions[id%uint64(len(c.partitions))] <- partitioned{id: id, msg: msg}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//Close waits for the workers to consume the messages they were handed and stops them
+func (c *PartitionedConsumer) Close() error {
+	for _, ch := range c.partitions {
+		close(ch)
+	}
+	c.wg.Wait()
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//This test shows the messages of every connection are consumed in order
+//while connections are spread over several partitions.
+func TestPartitionedConsumer(t *testing.T) {
+	const conns, msgs, partitions = 6, 50, 3
+	var mu sync.Mutex
+	received := make(map[uint64][]string)
+	total := 0
+	all := make(chan struct{})
+	c := NewPartitionedConsumer(partitions, func(id uint64, msg []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		received[id] = append(received[id], string(msg))
+		if total++; total == conns*msgs {
+			close(all)
+		}
+	})
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(WithPersister(c), WithEcho(false))
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, context.Background())
+		close(finished)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			w := bufio.NewWriter(conn)
+			for j := 0; j < msgs; j++ {
+				fmt.Fprintf(w, "%s %d\n", message, j)
+			}
+			w.Flush()
+		}()
+	}
+	wg.Wait()
+	select {
+	case <-all:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected all the messages to be consumed")
+	}
+	l.Close()
+	<-finished
+	c.Close()
+
+	if len(received) != conns {
+		t.Fatalf("Expected messages from %d connections but received %d", conns, len(received))
+	}
+	for id, ms := range received {
+		if len(ms) != msgs {
+			t.Fatalf("Expected %d messages from connection %d but received %d", msgs, id, len(ms))
+		}
+		for j, m := range ms {
+			if expected := fmt.Sprintf("%s %d", message, j); m != expected {
+				t.Fatalf("Expected '%s' from connection %d but received '%s'", expected, id, m)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"sync"
+)
+
+//Persister persists the messages received by the server.
+//It is called concurrently by all the connection handlers
+type Persister interface {
+	Persist(ctx context.Context, msg []byte) error
+}
+
+//ChannelPersister persists messages by sending them to a channel.
+//It is the default Persister, where Run prints everything it receives from the channel
+type ChannelPersister chan []byte
+
+//ErrChannelClosed is returned by ChannelPersister once its channel was closed
+var ErrChannelClosed = errors.New("message channel closed")
+
+//Persist waits for the channel to be drained, unless ctx is done first.
+//If the channel has room (or a consumer is waiting) the message is sent even if ctx is done.
+//Run only closes the server's channel after all its connections were handled,
+//but a handler that outlives it (e.g. one started by another Serve call) gets ErrChannelClosed instead of a panic
+func (p ChannelPersister) Persist(ctx context.Context, msg []byte) (err error) {
+	defer func() {
+		//sending on a closed channel is the only way to panic here
+		if recover() != nil {
+			err = ErrChannelClosed
+		}
+	}()
+	select {
+	case p <- msg:
+		return nil
+	default:
+	}
+	select {
+	case p <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//FilePersister persists messages by appending them to a file, one per line.
+//Messages are buffered until Close unless the file is synced (see: WithFsync)
+type FilePersister struct {
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	fsync bool
+}
+
+//FilePersisterOption configures a FilePersister, see: NewFilePersister
+type FilePersisterOption func(p *FilePersister)
+
+//WithFsync makes the FilePersister flush and fsync the file after every message,
+//so persisted messages survive a crash, at the cost of a disk write per message
+func WithFsync(fsync bool) FilePersisterOption {
+	return func(p *FilePersister) {
+		p.fsync = fsync
+	}
+}
+
+//NewFilePersister opens (or creates) the file at path for appending.
+//The caller is responsible for closing it, once the server is done with it
+func NewFilePersister(path string, opts ...FilePersisterOption) (*FilePersister, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p := &FilePersister{f: f, w: bufio.NewWriter(f)}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p, nil
+}
+
+//Persist appends msg followed by a newline to the file
+func (p *FilePersister) Persist(ctx context.Context, msg []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.w.Write(msg)
+	if err := p.w.WriteByte('\n'); err != nil {
+		return err
+	}
+	if !p.fsync {
+		return nil
+	}
+	if err := p.w.Flush(); err != nil {
+		return err
+	}
+	return p.f.Sync()
+}
+
+//Close flushes the buffered messages and closes the file
+func (p *FilePersister) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.w.Flush()
+	if cerr := p.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+//recordingPersister remembers every message and fails with err
+type recordingPersister struct {
+	mu   sync.Mutex
+	msgs []string
+	err  error
+}
+
+func (p *recordingPersister) Persist(ctx context.Context, msg []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.msgs = append(p.msgs, string(msg))
+	return p.err
+}
+
+func (p *recordingPersister) messages() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.msgs...)
+}
+
+//This test shows the handler persists messages with the configured Persister
+//and keeps going or closes the connection when persisting fails.
+func TestPersister(t *testing.T) {
+	for _, closeOnErr := range []bool{false, true} {
+		cliConn, servConn := tcpPair(t)
+		p := &recordingPersister{err: errors.New("disk full")}
+		s := NewServer(WithPersister(p), WithCloseOnPersistError(closeOnErr))
+		ctx, cancel := context.WithCancel(context.Background())
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s.handleConn(servConn, ctx)
+		}()
+
+		cliConn.Write([]byte(message + "\n"))
+		echo, err := bufio.NewReader(cliConn).ReadString('\n')
+		if closeOnErr {
+			if err := <-errCh; err != p.err {
+				t.Fatalf("Expected '%v' but received '%v'", p.err, err)
+			}
+			cancel()
+		} else {
+			//the failure doesn't affect the client
+			if echo != message+"\n" {
+				t.Fatalf("Expected '%s' but received '%s' (%v)", message, echo, err)
+			}
+			cancel()
+			<-errCh
+		}
+
+		if msgs := p.messages(); len(msgs) != 1 || msgs[0] != message {
+			t.Fatalf("Expected the persister to receive ['%s'] but received %v", message, msgs)
+		}
+	}
+}
+
+//This test shows messages are dropped instead of blocking the handler
+//when nobody drains mCh and its buffer is full.
+func TestDropOnFull(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	s := NewServer(WithDropOnFull(1))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	r := bufio.NewReader(cliConn)
+	for i := 0; i < 10; i++ {
+		cliConn.SetDeadline(time.Now().Add(time.Second))
+		cliConn.Write([]byte(message + "\n"))
+		//the handler keeps echoing although nothing is consumed
+		if echo := mustReadLine(t, r); echo != message+"\n" {
+			t.Fatalf("Expected '%s' but received '%s'", message, echo)
+		}
+	}
+	//only the first message fits in the buffer
+	if dropped := s.DroppedMessages(); dropped != 9 {
+		t.Fatalf("Expected 9 dropped messages but received %d", dropped)
+	}
+	if len(s.mCh) != 1 {
+		t.Fatalf("Expected 1 message in mCh but received %d", len(s.mCh))
+	}
+}
+
+//This test shows ChannelPersister gives up when nobody drains the channel and ctx is cancelled.
+func TestChannelPersisterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- ChannelPersister(make(chan []byte)).Persist(ctx, []byte(message))
+	}()
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Fatalf("Expected '%v' but received '%v'", context.Canceled, err)
+	}
+}
+
+//This benchmark shows buffering mCh lets the handlers persist messages
+//without waiting for the consumer every time.
+//Run with: go test -bench ChannelPersister
+func BenchmarkChannelPersister(b *testing.B) {
+	for _, size := range []int{0, 16, 256} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			mCh := make(chan []byte, size)
+			done := make(chan struct{})
+			go func() {
+				for m := range mCh {
+					fmt.Fprintln(io.Discard, "Received message:", string(m))
+				}
+				close(done)
+			}()
+			p := ChannelPersister(mCh)
+			msg := []byte(message)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					p.Persist(context.Background(), msg)
+				}
+			})
+			close(mCh)
+			<-done
+		})
+	}
+}
+
+//This test shows FilePersister appends the messages to the file in order,
+//with and without syncing every message.
+func TestFilePersister(t *testing.T) {
+	for _, fsync := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "messages.log")
+		//the file is appended to, not truncated
+		if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		p, err := NewFilePersister(path, WithFsync(fsync))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cliConn, servConn := tcpPair(t)
+		s := NewServer(WithPersister(p))
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s.persistAndEcho(servConn, ctx)
+		}()
+
+		r := bufio.NewReader(cliConn)
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(cliConn, "%s %d\n", message, i)
+			if _, err := r.ReadString('\n'); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cancel()
+		<-errCh
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := fmt.Sprintf("old\n%[1]s 0\n%[1]s 1\n%[1]s 2\n", message)
+		if string(data) != expected {
+			t.Fatalf("Expected '%s' but received '%s' (fsync=%v)", expected, data, fsync)
+		}
+	}
+}
+
+//This test shows ChannelPersister doesn't panic once the channel was closed.
+func TestChannelPersisterClosed(t *testing.T) {
+	mCh := make(chan []byte)
+	close(mCh)
+	if err := ChannelPersister(mCh).Persist(context.Background(), []byte(message)); err != ErrChannelClosed {
+		t.Fatalf("Expected '%v' but received '%v'", ErrChannelClosed, err)
+	}
+}
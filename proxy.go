@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//maxProxyHeaderSize is the longest PROXY protocol v1 header, including the "\r\n"
+const maxProxyHeaderSize = 107
+
+//proxyHeaderTimeout bounds the time a client may take to send the PROXY protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+var errNoProxyHeader = errors.New("missing PROXY protocol header")
+
+//readProxyHeader reads the PROXY protocol v1 header from conn and returns the client's address.
+//It reads a byte at a time, so nothing after the header is consumed and the handler gets conn as it is
+func (s *Server) readProxyHeader(conn net.Conn) (net.Addr, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer clearReadDeadline(conn)
+	var header []byte
+	b := make([]byte, 1)
+	for !strings.HasSuffix(string(header), "\r\n") {
+		if len(header) == maxProxyHeaderSize {
+			return nil, errNoProxyHeader
+		}
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		header = append(header, b[0])
+	}
+	return parseProxyHeader(strings.TrimSuffix(string(header), "\r\n"), conn.RemoteAddr())
+}
+
+//parseProxyHeader parses a PROXY protocol v1 header line (without the "\r\n"), e.g.
+//"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443".
+//remote is returned for UNKNOWN connections, like the load balancer's health checks
+func parseProxyHeader(line string, remote net.Addr) (net.Addr, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errNoProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return remote, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid PROXY protocol header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid PROXY protocol addresses in %q", line)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol source port in %q", line)
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol destination port in %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+//This test shows the client's address is taken from the PROXY protocol header
+//and the rest of the connection is handled as usual.
+func TestProxyProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remotes := make(chan net.Addr, 1)
+	s := NewServer(WithProxyProtocol(true), WithPersister(&recordingPersister{}),
+		WithMiddleware(func(next Handler) Handler {
+			return func(conn net.Conn, ctx context.Context) error {
+				remotes <- RemoteAddr(ctx)
+				return next(conn, ctx)
+			}
+		}))
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, context.Background())
+		close(finished)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n" + message + "\n"))
+	if echo, err := bufio.NewReader(conn).ReadString('\n'); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s' (%v)", message, echo, err)
+	}
+	if remote := <-remotes; remote.String() != "192.168.0.1:56324" {
+		t.Fatalf("Expected '192.168.0.1:56324' but received '%v'", remote)
+	}
+	conn.Close()
+
+	//without a header the connection is closed
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(message + "\r\n"))
+	if b, err := io.ReadAll(conn); len(b) != 0 || err != nil {
+		t.Fatalf("Expected the connection to be closed but received '%s' (%v)", b, err)
+	}
+	conn.Close()
+	l.Close()
+	<-finished
+}
+
+//This test shows which PROXY protocol headers are accepted.
+func TestParseProxyHeader(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	for _, tc := range []struct {
+		line     string
+		expected string //empty for an error
+	}{
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443", "192.168.0.1:56324"},
+		{"PROXY TCP6 ::1 ::1 56324 443", "[::1]:56324"},
+		{"PROXY UNKNOWN", remote.String()},
+		{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535", remote.String()},
+		{"PROXY TCP4 ::1 ::1 56324 443", ""},
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 99999 443", ""},
+		{"PROXY TCP4 192.168.0.1 192.168.0.11", ""},
+		{"PROXY UDP4 192.168.0.1 192.168.0.11 56324 443", ""},
+		{message, ""},
+	} {
+		addr, err := parseProxyHeader(tc.line, remote)
+		if tc.expected == "" {
+			if err == nil {
+				t.Fatalf("Expected '%s' to be invalid but received '%v'", tc.line, addr)
+			}
+			continue
+		}
+		if err != nil || addr.String() != tc.expected {
+			t.Fatalf("Expected '%s' for '%s' but received '%v' (%v)", tc.expected, tc.line, addr, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+//Limits are the limits of the default handler that can be changed while the server is running, see: SetLimits.
+//Zero values mean the defaults of the options that set them
+type Limits struct {
+	//MessageRate and MessageBurst limit the messages of every connection, see: WithMessageRateLimit
+	MessageRate  float64
+	MessageBurst int
+	//MaxMessageSize is the maximum size of a message, see: WithMaxLineSize
+	MaxMessageSize int
+}
+
+//SetLimits replaces the limits set by the options.
+//The connections being handled get the new limits with their next message,
+//a connection that is rate limited starts over with a full burst
+func (s *Server) SetLimits(l Limits) {
+	s.currentLimits.Store(&l)
+}
+
+//Limits returns the current limits, see: SetLimits
+func (s *Server) Limits() Limits {
+	return *s.currentLimits.Load()
+}
+
+//limitSize wraps the framer's split function to enforce the current maximum message size.
+//The limit works like a bufio.Scanner buffer of that size (plus the framing overhead) would
+func (s *Server) limitSize(f Framer) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		limit := bufio.MaxScanTokenSize
+		if l := s.currentLimits.Load(); l.MaxMessageSize > 0 {
+			limit = l.MaxMessageSize + maxFrameOverhead(f)
+		}
+		advance, token, err := f.Split(data, atEOF)
+		if advance > limit || (err == nil && advance == 0 && len(data) >= limit) {
+			return 0, nil, bufio.ErrTooLong
+		}
+		return advance, token, err
+	}
+}
+
+//reloadOnSIGHUP replaces the limits with the ones loaded by s.reload on every SIGHUP until the server is done.
+//It's registered for the signal when it returns
+func (s *Server) reloadOnSIGHUP() {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigc)
+		for {
+			select {
+			case <-sigc:
+			case <-s.done:
+				return
+			}
+			l, err := s.reload()
+			if err != nil {
+				//keep the limits we have
+				s.logger.Error("Reloading the limits failed", "err", err)
+				continue
+			}
+			s.SetLimits(l)
+			s.logger.Info("Reloaded the limits", "rate", l.MessageRate, "burst", l.MessageBurst, "max_message_size", l.MaxMessageSize)
+		}
+	}()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+//This test shows a connection gets new limits with its next message.
+func TestSetLimits(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	s := NewServer(WithPersister(&recordingPersister{}), WithMaxMessageSize(len(message)))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.handleConn(servConn, context.Background())
+	}()
+	r := bufio.NewReader(cliConn)
+	long := strings.Repeat(message, 2)
+
+	//the connection already started with the old limit
+	s.SetLimits(Limits{MaxMessageSize: len(long)})
+	cliConn.Write([]byte(long + "\n"))
+	if echo := mustReadLine(t, r); echo != long+"\n" {
+		t.Fatalf("Expected '%s' but received '%s'", long, echo)
+	}
+
+	s.SetLimits(Limits{MaxMessageSize: len(message)})
+	if l := s.Limits(); l.MaxMessageSize != len(message) {
+		t.Fatalf("Expected the maximum message size to be %d but received %d", len(message), l.MaxMessageSize)
+	}
+	cliConn.Write([]byte(message + "\n" + long + "\n"))
+	if echo := mustReadLine(t, r); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s'", message, echo)
+	}
+	if err := <-errCh; err != bufio.ErrTooLong {
+		t.Fatalf("Expected '%v' but received '%v'", bufio.ErrTooLong, err)
+	}
+	if resp, _ := io.ReadAll(r); string(resp) != string(defaultTooLargeResponse)+"\n" {
+		t.Fatalf("Expected '%s' but received '%s'", defaultTooLargeResponse, resp)
+	}
+}
+
+//This test shows a connection over the new rate limit is closed with its next message.
+func TestSetLimitsRate(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	s := NewServer(WithPersister(&recordingPersister{}), WithMaxRateViolations(1))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.persistAndEcho(servConn, context.Background())
+	}()
+	r := bufio.NewReader(cliConn)
+	for i := 0; i < 3; i++ {
+		cliConn.Write([]byte(message + "\n"))
+		mustReadLine(t, r)
+	}
+
+	s.SetLimits(Limits{MessageRate: 0.001, MessageBurst: 1})
+	cliConn.Write([]byte(message + "\n" + message + "\n"))
+	mustReadLine(t, r)
+	if err := <-errCh; err != ErrRateLimited {
+		t.Fatalf("Expected '%v' but received '%v'", ErrRateLimited, err)
+	}
+}
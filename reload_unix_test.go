@@ -0,0 +1,54 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//This test shows the limits are reloaded on SIGHUP and kept when reloading fails.
+func TestReloadOnSIGHUP(t *testing.T) {
+	loaded := make(chan struct{}, 1)
+	var calls atomic.Int32
+	load := func() (Limits, error) {
+		defer func() { loaded <- struct{}{} }()
+		//the second configuration is broken
+		if calls.Add(1) > 1 {
+			return Limits{}, errors.New("bad config")
+		}
+		return Limits{MaxMessageSize: 42}, nil
+	}
+	var logs syncBuffer
+	s := NewServer(WithAddr(addr), WithReloadOnSIGHUP(load), WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	<-s.Ready()
+
+	for i := 0; i < 2; i++ {
+		syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+		select {
+		case <-loaded:
+		case <-time.After(time.Second):
+			t.Fatal("Expected the limits to be reloaded")
+		}
+	}
+	//the failure is logged right after it's loaded
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(logs.String(), "Reloading the limits failed") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if l := s.Limits(); l.MaxMessageSize != 42 {
+		t.Fatalf("Expected the maximum message size to be 42 but received %d", l.MaxMessageSize)
+	}
+	if !strings.Contains(logs.String(), "Reloading the limits failed") {
+		t.Fatalf("Expected the failure to be logged but received:\n%s", logs.String())
+	}
+}
@@ -1,23 +1,75 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"os"
 	"os/signal"
 	"context"
+	"crypto/tls"
 	"runtime"
+	"runtime/debug"
 	"fmt"
 	"syscall"
 	"bufio"
 	"time"
+	"io"
+	"bytes"
+	"strconv"
+	"encoding/json"
+	"math"
+	"errors"
+	"math/rand/v2"
+	"strings"
 )
 
 var aLongTimeAgo = time.Unix(233431200, 0)
 
+//invalidJSONResponse is framed like an echo instead of the echo of an invalid message, see: WithJSONValidation
+var invalidJSONResponse = []byte("ERR invalid json")
+
+//errInvalidJSON closes the connection on an invalid message, see: WithStrictProtocol
+var errInvalidJSON = errors.New("invalid json")
+
+//defaultShutdownTimeout is how long Run waits for the connections once it's terminating, see: WithShutdownTimeout
+const defaultShutdownTimeout = 30 * time.Second
+
+//ErrShutdownTimeout is returned by Run when the connections were still handled after the shutdown timeout
+var ErrShutdownTimeout = errors.New("shutdown timed out")
+
+//minAcceptBackoff and defaultMaxAcceptBackoff bound the delay between temporary accept errors, see: WithMaxAcceptBackoff
+const (
+	minAcceptBackoff        = 5 * time.Millisecond
+	defaultMaxAcceptBackoff = time.Second
+)
+
+//initialBufferSize is the size bufio.Scanner starts with
+const initialBufferSize = 4096
+
+//scanBuffers are the initial scanner buffers, reused by the connections one at a time (see: WithBufferPool)
+var scanBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, initialBufferSize)
+		return &buf
+	},
+}
+
 //Our super important operation that must not be interrupted in the middle
-func PersistAndEcho(mCh chan []byte, conn net.Conn, ctx context.Context) {
+//Cancelling ctx stops it even while it waits for mCh to be drained
+//It doesn't close conn, that's up to the caller, just like Serve does
+func PersistAndEcho(mCh chan []byte, conn net.Conn, ctx context.Context) error {
+	return NewServer(WithMessageChannel(mCh)).persistAndEcho(conn, ctx)
+}
+
+func (s *Server) persistAndEcho(conn net.Conn, ctx context.Context) error {
+	logger := s.connLogger(ctx)
+	if gz, ok := s.compress(conn, ctx).(*gzipConn); ok && gz != conn {
+		//it wasn't accepted by Serve, which ends the gzip stream when it closes the connection
+		conn = gz
+		defer gz.endStream()
+	}
 	go func() {
 		<-ctx.Done()
 		// Found a nice cheat!
@@ -25,74 +77,1087 @@ func PersistAndEcho(mCh chan []byte, conn net.Conn, ctx context.Context) {
 		// for future Read calls
 		// ***and any currently-blocked Read call***
 		// Yay!
-		conn.SetReadDeadline(aLongTimeAgo)
-		log.Println("Connection context cancelled.")
+		interruptRead(conn)
+		logger.Info("Connection context cancelled.", "err", ctx.Err())
 	}()
 
-	s:=bufio.NewScanner(conn)
-	for s.Scan(){
-		mCh <- s.Bytes()
-		conn.Write(s.Bytes())
-		conn.Write([]byte("\n"))
+	//messages read before the limit is reached are handled as usual
+	first := &firstByteReader{r: s.limitBytes(conn), arrived: func() { s.resetReadDeadline(conn, ctx) }}
+	r := &messageReader{s: s, r: first, conn: conn, ctx: ctx}
+	handled := make(chan struct{})
+	defer close(handled)
+	go s.watchShutdown(conn, handled)
+	sc := bufio.NewScanner(r)
+	sc.Split(r.split(s.limitSize(s.framerOf(ctx))))
+	//the buffer grows only for clients that send long messages,
+	//up to the maximum message size checked by the split function since it may change (see: SetLimits)
+	if s.poolBuffers {
+		//the buffer is ours until the connection is done, messages are copied out of it before they're handled
+		buf := scanBuffers.Get().(*[]byte)
+		defer scanBuffers.Put(buf)
+		sc.Buffer((*buf)[:0], math.MaxInt)
+	} else {
+		sc.Buffer(make([]byte, 0, initialBufferSize), math.MaxInt)
+	}
+	var stopErr error //set (and logged) when we stop handling the connection ourselves
+	var reason CloseReason
+	limits := s.currentLimits.Load()
+	limiter, violations := s.newRateLimiter(limits), 0
+	var seq uint64 //the number of the last sequenced echo
+	var recent *dedup
+	if s.dedupWindow > 0 {
+		recent = newDedup(s.dedupWindow)
+	}
+	if s.banner != nil {
+		//it isn't an echo, it goes out as it is
+		if err := s.reply(conn, ctx, s.banner); err != nil {
+			stopErr, reason = writeError(logger, ctx, "Banner", err)
+		}
+	}
+	//during a graceful shutdown we stop after the messages we already received (see: messageReader)
+	for s.awaitFirstByte(conn, ctx); reason == CloseReasonUnknown && sc.Scan(); s.awaitMessage(conn, ctx) {
+		s.setState(conn, StateActive)
+		if l := s.currentLimits.Load(); l != limits {
+			//the limits were reloaded, the connection starts over with the new rate
+			limits = l
+			limiter = s.newRateLimiter(limits)
+		}
+		//sc.Bytes() is overwritten by the next Scan, so the persister gets its own copy
+		msg := append([]byte(nil), sc.Bytes()...)
+		if s.trimCutset != "" {
+			msg = bytes.TrimRight(msg, s.trimCutset)
+		}
+		if s.pingRequest != nil && bytes.Equal(msg, s.pingRequest) {
+			//health checks aren't messages, don't persist them
+			if err := s.echo(conn, ctx, s.pingResponse); err != nil {
+				stopErr, reason = writeError(logger, ctx, "Ping response", err)
+				break
+			}
+			continue
+		}
+		if s.quitCommand != nil && bytes.Equal(msg, s.quitCommand) {
+			//the client is done, saying so isn't a message either
+			if s.farewell != nil {
+				if err := s.echo(conn, ctx, s.farewell); err != nil {
+					stopErr, reason = writeError(logger, ctx, "Farewell", err)
+					break
+				}
+			}
+			logger.Info("Client quit")
+			reason = CloseQuit
+			break
+		}
+		if s.validateJSON && !json.Valid(msg) {
+			if err := s.echo(conn, ctx, invalidJSONResponse); err != nil {
+				stopErr, reason = writeError(logger, ctx, "Invalid JSON response", err)
+				break
+			}
+			if s.strictProtocol {
+				logger.Warn("Invalid JSON, rejecting the connection")
+				RejectConnection(ctx)
+				stopErr, reason = errInvalidJSON, CloseRejected
+				break
+			}
+			continue
+		}
+		s.metrics.ObserveMessageBytes(len(msg))
+		if err := s.waitForToken(limiter, &violations, ctx); err != nil {
+			if ctx.Err() == nil {
+				logger.Warn("Client exceeds the message rate limit", "err", err, "violations", violations)
+				stopErr, reason = err, CloseRateLimited
+			}
+			break
+		}
+		persist, echo := true, s.echoes
+		if s.messageHook != nil {
+			var err error
+			if persist, echo, err = s.messageHook(ctx, msg); err != nil {
+				logger.Warn("Message hook rejected the connection", "err", err)
+				RejectConnection(ctx)
+				stopErr, reason = err, CloseRejected
+				break
+			}
+			echo = echo && s.echoes
+		}
+		if persist && recent != nil && recent.duplicate(msg, time.Now()) {
+			//a retransmission, the client still gets its echo
+			persist = false
+			s.deduped.Add(1)
+		}
+		if persist {
+			if err := s.persisterOf(ctx).Persist(ctx, msg); err != nil {
+				if ctx.Err() != nil {
+					//we were interrupted while waiting for the persister
+					s.dropped.Add(1)
+					break
+				}
+				logger.Error("Persisting message failed", "err", err)
+				if s.closeOnPersistError || err == ErrQueueFull {
+					stopErr, reason = err, ClosePersistError
+					break
+				}
+				s.metrics.IncErrors() //otherwise counted by Serve
+			} else {
+				s.persisted.Add(1)
+				s.persistedBytes.Add(uint64(len(msg)))
+				if recent != nil {
+					recent.remember(msg, time.Now())
+				}
+				s.forward(msg)
+				if s.shuttingDown() {
+					s.drained.Add(1)
+				}
+			}
+		}
+		if !echo {
+			continue
+		}
+		if s.echoTransform != nil {
+			//the persister may still be using msg, the transform gets its own copy
+			msg = s.echoTransform(append([]byte(nil), msg...))
+		}
+		if s.sequencedEcho {
+			//the persister has its own copy, we may build on msg
+			seq++
+			msg = append(append(strconv.AppendUint(nil, seq, 10), ' '), msg...)
+		}
+		if err := s.echo(conn, ctx, msg); err != nil {
+			stopErr, reason = writeError(logger, ctx, "Echo", err)
+			break
+		}
+		s.echoedBytes.Add(uint64(len(msg)))
+	}
+	//Scan returns false both on EOF and on errors, tell them apart
+	err := sc.Err()
+	switch {
+	case reason != CloseReasonUnknown:
+		//we stopped ourselves, and said why
+		err = stopErr
+	case err == nil && ctx.Err() != nil:
+		logger.Info("Connection interrupted", "err", ctx.Err())
+		reason = CloseShutdown
+	case err == errDraining:
+		logger.Info("Server shutting down, done with the connection")
+		reason = CloseShutdown
+		err = nil
+	case err == nil:
+		logger.Info("Connection closed by client")
+		reason = CloseClientEOF
+	case err == ErrTooManyBytes:
+		logger.Warn("Client exceeds the maximum bytes per connection", "err", err, "max", s.maxBytesPerConn)
+		reason = CloseTooManyBytes
+	case err == bufio.ErrTooLong:
+		//the line was dropped, at least let everyone know why
+		logger.Warn("Line exceeds the maximum line size", "err", err)
+		reason = CloseMessageTooLarge
+		if s.tooLargeResponse != nil {
+			if werr := s.echo(conn, ctx, s.tooLargeResponse); werr != nil {
+				//the connection is closed for the message either way, only log why the client wasn't told
+				writeError(logger, ctx, "Too large response", werr)
+			}
+		}
+	case ctx.Err() != nil:
+		//we interrupted the read ourselves (see above), not an error
+		logger.Info("Connection read interrupted", "err", ctx.Err())
+		reason = CloseShutdown
+		err = nil
+	case s.firstByteTimeout > 0 && !first.started && isTimeout(err):
+		//slow loris, or just a client that connected for nothing
+		logger.Warn("Idle handshake timeout", "timeout", s.firstByteTimeout)
+		reason = CloseIdleTimeout
+		err = nil
+	case s.idleTimeout > 0 && isTimeout(err):
+		logger.Info("Connection idle timeout", "timeout", s.idleTimeout)
+		reason = CloseIdleTimeout
+		err = nil
+	default:
+		logger.Error("Connection read error", "err", err)
+		reason = CloseReadError
+	}
+	//Serve closes the connection, see: Handler
+	logger.Info("Closing connection", "reason", s.setCloseReason(ctx, reason))
+	return err
+}
+
+//awaitMessage is called after every message, the connection is idle until the next one
+func (s *Server) awaitMessage(conn net.Conn, ctx context.Context) {
+	s.setState(conn, StateIdle)
+	s.resetIdleDeadline(conn, ctx)
+}
+
+//awaitFirstByte gives the client the first byte timeout to start sending (see: WithFirstByteTimeout),
+//or the idle timeout without one
+func (s *Server) awaitFirstByte(conn net.Conn, ctx context.Context) {
+	if s.firstByteTimeout <= 0 {
+		s.resetIdleDeadline(conn, ctx)
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(s.firstByteTimeout))
+	if ctx.Err() != nil {
+		interruptRead(conn)
+	}
+}
+
+//awaitHandshake gives the client the first byte timeout to start a handshake that comes before the handler,
+//e.g. TLS, or the idle timeout without one. The deadline is cleared once the handshake is done
+func (s *Server) awaitHandshake(conn net.Conn) (done func()) {
+	d := s.firstByteTimeout
+	if d <= 0 {
+		d = s.idleTimeout
+	}
+	if d <= 0 {
+		return func() {}
+	}
+	conn.SetReadDeadline(time.Now().Add(d))
+	return func() { clearReadDeadline(conn) }
+}
+
+//resetReadDeadline replaces the first byte deadline with the idle deadline (or none) once the first byte arrived
+func (s *Server) resetReadDeadline(conn net.Conn, ctx context.Context) {
+	if s.firstByteTimeout <= 0 {
+		return
+	}
+	if s.idleTimeout > 0 {
+		s.resetIdleDeadline(conn, ctx)
+		return
+	}
+	clearReadDeadline(conn)
+	if ctx.Err() != nil {
+		interruptRead(conn)
+	}
+}
+
+//resetIdleDeadline gives the client another idle timeout to send the next message
+func (s *Server) resetIdleDeadline(conn net.Conn, ctx context.Context) {
+	if s.idleTimeout <= 0 {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+	//the context may have been cancelled while we were setting the deadline
+	//in which case we just overrode aLongTimeAgo, put it back.
+	//if it's cancelled after the check, the cancellation goroutine sets it after us
+	if ctx.Err() != nil {
+		interruptRead(conn)
+	}
+}
+
+//echo writes msg back to the client as a single frame (by default followed by a newline).
+//Echoes to a connection accepted by Serve don't interleave with broadcasts (see: Broadcast)
+func (s *Server) echo(conn net.Conn, ctx context.Context, msg []byte) error {
+	if c := s.lookup(conn, ctx); c != nil {
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+		return s.bufferFrame(c, msg)
+	}
+	return s.writeFrame(conn, s.framerOf(ctx), msg)
+}
+
+//reply writes resp to the client as it is, without framing it
+func (s *Server) reply(conn net.Conn, ctx context.Context, resp []byte) error {
+	if _, ok := s.framerOf(ctx).(webSocketFramer); ok {
+		//WebSocket clients only understand frames
+		return s.echo(conn, ctx, bytes.TrimSuffix(resp, []byte("\n")))
+	}
+	if c := s.lookup(conn, ctx); c != nil {
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+		if c.closed {
+			return net.ErrClosed
+		}
+		//after the echoes that are still buffered
+		if s.writeTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		}
+		if _, err := c.w.Write(resp); err != nil {
+			return err
+		}
+		return s.flush(c)
+	}
+	if s.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+	_, err := conn.Write(resp)
+	return err
+}
+
+//writeFrame writes msg to conn as a single frame of f, within the write timeout
+func (s *Server) writeFrame(conn net.Conn, f Framer, msg []byte) error {
+	if s.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+	return f.WriteFrame(conn, msg)
+}
+
+//nextAcceptDelay doubles the delay before retrying a temporary accept error,
+//starting at 5ms and up to the maximum accept backoff (see: WithMaxAcceptBackoff)
+func (s *Server) nextAcceptDelay(prev time.Duration) time.Duration {
+	limit := s.maxAcceptBackoff
+	if limit <= 0 {
+		limit = defaultMaxAcceptBackoff
+	}
+	return min(max(2*prev, minAcceptBackoff), limit)
+}
+
+//jitter returns a random delay between d/2 and d,
+//so the servers that ran out of file descriptors together don't retry together
+func jitter(d time.Duration) time.Duration {
+	return d/2 + rand.N(d/2+1)
+}
+
+//isTemporary reports whether err is a temporary accept error, which doesn't stop Serve
+func isTemporary(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Temporary() //deprecated, but still what net/http relies on for Accept
+}
+
+//writeError logs why writing what to the client handled with ctx failed with err,
+//and returns the error and reason the handler stops with.
+//A client that closed the connection before reading its echo isn't an error
+func writeError(logger *slog.Logger, ctx context.Context, what string, err error) (error, CloseReason) {
+	switch {
+	case ctx.Err() != nil:
+		//e.g. CloseConnection closed it under us
+		logger.Info(what+" write interrupted", "err", err, "reason", CloseShutdown)
+		return nil, CloseShutdown
+	case isTimeout(err):
+		//the client stopped reading, don't wait for it forever
+		logger.Warn(what+" write timed out", "err", err, "reason", CloseWriteTimeout)
+		return err, CloseWriteTimeout
+	case errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET):
+		logger.Info("Client closed the connection before reading the "+strings.ToLower(what), "err", err, "reason", CloseClientEOF)
+		return nil, CloseClientEOF
+	}
+	logger.Warn(what+" write failed", "err", err, "reason", CloseWriteError)
+	return err, CloseWriteError
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+//Handler handles a single connection until it is closed or ctx is cancelled.
+//Serve logs the returned error and closes the connection once the handler returns,
+//handlers shouldn't close it themselves
+type Handler func(conn net.Conn, ctx context.Context) error
+
+//NoError adapts a handler that can't fail to a Handler
+func NoError(handle func(conn net.Conn, ctx context.Context)) Handler {
+	return func(conn net.Conn, ctx context.Context) error {
+		handle(conn, ctx)
+		return nil
 	}
-	log.Println("Closing connection")
-	conn.Close()
 }
 
-type Handler func(conn net.Conn, ctx context.Context)
+//Serve is kept for backwards compatibility.
+//It serves l with handle and the default configuration, see: Server.Serve
+func Serve(l net.Listener, ctx context.Context, handle Handler) error {
+	return NewServer(WithHandler(handle)).Serve(l, ctx)
+}
 
-func Serve(l net.Listener, ctx context.Context, handle Handler) (err error) {
+//Serve accepts connections on l and handles each one in its own goroutine.
+//It returns when l.Accept fails, after all the connections were handled.
+//It returns nil if the server closed l itself (see: Run and Shutdown) and the accept error otherwise.
+//Temporary accept errors are retried with an increasing delay (up to 1s, see: WithMaxAcceptBackoff).
+//With an accept timeout (see: WithAcceptTimeout) it also returns ctx.Err() once ctx is cancelled.
+func (s *Server) Serve(l net.Listener, ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sv := s.startServing(l, cancel)
+	defer s.stopServing(sv)
+	deadliner, _ := l.(acceptDeadliner)
 	var wg sync.WaitGroup
 	var conn net.Conn
+	var retryDelay time.Duration
 	for {
+		if s.acceptTimeout > 0 && deadliner != nil {
+			deadliner.SetDeadline(time.Now().Add(s.acceptTimeout))
+		}
 		conn, err = l.Accept()
+		if s.acceptTimeout > 0 && isTimeout(err) {
+			//nobody connected in time, a chance to notice we were cancelled
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			continue
+		}
+		if isTemporary(err) {
+			//e.g. running out of file descriptors, retry like net/http does
+			retryDelay = s.nextAcceptDelay(retryDelay)
+			delay := jitter(retryDelay)
+			s.logger.Warn("Accept failed, retrying", "err", err, "delay", delay)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-ctx.Done():
+			}
+		}
 		if err != nil {
 			break
 		}
-		log.Println("Accepted connection")
+		if conn == nil {
+			//a custom listener with neither a connection nor an error, there's nothing to handle
+			s.logger.Warn("Accept returned no connection, skipping")
+			continue
+		}
+		retryDelay = 0
+		if !s.proxyProtocol && !s.allowed(conn.RemoteAddr()) {
+			//behind a proxy we only know the client once we read the header, see: serveConn
+			s.logger.Warn("IP not allowed, rejecting connection", "remote", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		if !s.acquireConn() {
+			s.logger.Warn("Too many connections, rejecting connection", "remote", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
 		wg.Add(1)
 		go func(conn net.Conn) {
-			connCtx, cancel := context.WithCancel(ctx)
-			defer func() {
-				cancel()
-				conn.Close() //design choice here
-				wg.Done()
-			}()
-			handle(conn, connCtx)
+			defer wg.Done()
+			defer s.releaseConn()
+			s.serveConn(conn, ctx)
 		}(conn)
 	}
 	wg.Wait()
+	if s.closing.Load() {
+		//we closed the listener ourselves, that's a clean shutdown
+		return nil
+	}
 	return err
 }
 
-func Run(addr string, ready chan struct{}, ctx context.Context) {
-	l, err := net.Listen("tcp", addr)
+//serveConn handles a single connection accepted by Serve, once it got a connection slot
+func (s *Server) serveConn(conn net.Conn, ctx context.Context) {
+	remote := conn.RemoteAddr()
+	if s.proxyProtocol {
+		//behind a load balancer the real client is in the header
+		var err error
+		if remote, err = s.readProxyHeader(conn); err != nil {
+			s.logger.Error("Invalid PROXY protocol header, closing connection", "remote", conn.RemoteAddr().String(), "err", err)
+			s.metrics.IncErrors()
+			conn.Close()
+			return
+		}
+		if !s.allowed(remote) {
+			s.logger.Warn("IP not allowed, rejecting connection", "remote", remote.String())
+			conn.Close()
+			return
+		}
+	}
+	if s.tlsConfig != nil {
+		//the TLS handshake follows the PROXY header, see: handshake
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+	ip, ok := s.acquireIP(remote)
+	if !ok {
+		s.logger.Warn("Too many connections from the same IP, rejecting connection", "remote", remote.String())
+		conn.Close()
+		return
+	}
+	defer s.releaseIP(ip)
+	id := s.nextConnID.Add(1)
+	logger := s.sampleLogger(s.logger.With("conn", id, "remote", remote.String()), id)
+	logger.Info("Accepted connection")
+
+	s.addActive(1)
+	s.metrics.IncConnections()
+	connCtx := context.WithValue(ctx, connIDKey{}, id)
+	connCtx = context.WithValue(connCtx, remoteAddrKey{}, remote)
+	connCtx = context.WithValue(connCtx, loggerKey{}, logger)
+	var cancel context.CancelFunc
+	if s.connTimeout > 0 {
+		//the handler is interrupted just like when ctx is cancelled
+		connCtx, cancel = context.WithTimeout(connCtx, s.connTimeout)
+	} else {
+		connCtx, cancel = context.WithCancel(connCtx)
+	}
+	idCtx := connCtx
+	connCtx = context.WithValue(connCtx, rejectKey{}, func() {
+		//the reason goes first, the handler sees the cancelled context as its own reason otherwise
+		s.setCloseReason(idCtx, CloseRejected)
+		cancel()
+	})
+	var reported bool //whether the hook knows about the connection
+	var entry *connEntry
+	defer func() {
+		cancel()
+		if reported {
+			//closed by closeHandled already
+			s.setState(conn, StateClosed)
+			if s.closeHook != nil {
+				s.closeHook(entry.info())
+			}
+		} else {
+			s.closeConn(conn) //design choice here
+		}
+		s.addActive(-1)
+		s.metrics.DecConnections()
+	}()
+	//one bad connection shouldn't take the whole server down
+	defer s.recoverPanic(conn, logger)
+	if err := s.setKeepAlive(conn); err != nil {
+		logger.Warn("Setting keep-alive failed", "err", err)
+	}
+	if err := s.handshake(conn, connCtx); err != nil {
+		if isTimeout(err) {
+			//the client never said hello, see: WithFirstByteTimeout
+			logger.Warn("Idle handshake timeout", "err", err)
+			return
+		}
+		logger.Error("TLS handshake failed", "err", err)
+		s.metrics.IncErrors()
+		return
+	}
+	if cn, ok := peerCommonName(conn); ok {
+		connCtx = context.WithValue(connCtx, identityKey{}, cn)
+	}
+	connCtx = s.route(conn, connCtx)
+	if s.countBytes {
+		counted := &countingConn{Conn: conn}
+		conn = counted
+		connCtx = context.WithValue(connCtx, bytesKey{}, counted)
+		defer func() {
+			logger.Info("Connection bytes", "read", counted.read.Load(), "wrote", counted.written.Load())
+		}()
+	}
+	if s.webSocket {
+		var ws bool
+		var err error
+		if conn, ws, err = s.upgradeWebSocket(conn, connCtx); err != nil {
+			logger.Warn("WebSocket handshake failed", "err", err)
+			return
+		}
+		if ws {
+			logger.Info("Upgraded to WebSocket")
+			connCtx = context.WithValue(connCtx, framerKey{}, webSocketFramer{})
+		}
+	}
+	//the handler and Broadcast both write compressed frames, the counters count what's on the wire
+	conn = s.compress(conn, connCtx)
+	entry = s.register(conn, connCtx, cancel)
+	defer s.unregister(id)
+	//custom handlers don't flush the echoes they leave behind,
+	//and the connection is closed after the writes of Broadcast that are in flight
+	defer s.closeHandled(conn, connCtx)
+	s.setState(conn, StateNew)
+	reported = true
+	if err := s.handlerOf(connCtx)(conn, connCtx); err != nil {
+		logger.Error("Handler failed", "err", err)
+		s.metrics.IncErrors()
+	}
+}
+
+//recoverPanic recovers from a panic in the handler of conn
+//and reports it to the panic handler (see: WithPanicHandler), by default logging it
+func (s *Server) recoverPanic(conn net.Conn, logger *slog.Logger) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	s.metrics.IncErrors()
+	if s.panicHandler != nil {
+		s.panicHandler(conn, v)
+		return
+	}
+	logger.Error("Handler panicked", "panic", v, "stack", string(debug.Stack()))
+}
+
+//acquireConn takes a connection slot, if the number of connections is limited.
+//When all the slots are taken it either waits for one to free up
+//or gives up, depending on WithRejectOnFull
+func (s *Server) acquireConn() bool {
+	if s.connSlots == nil {
+		return true
+	}
+	if !s.rejectOnFull {
+		s.connSlots <- struct{}{}
+		return true
+	}
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) releaseConn() {
+	if s.connSlots != nil {
+		<-s.connSlots
+	}
+}
+
+//ActiveConnections returns the number of connections currently being handled.
+//It is safe to call while the server is running
+func (s *Server) ActiveConnections() int {
+	return int(s.activeConns.Load())
+}
+
+//WaitForConnections waits until exactly n connections are being handled (see: ActiveConnections),
+//e.g. in tests, instead of signaling from the handler. It returns ctx.Err() if ctx is done first
+func (s *Server) WaitForConnections(ctx context.Context, n int) error {
+	for {
+		s.activeMu.Lock()
+		active, changed := s.activeConns.Load(), s.activeChanged
+		s.activeMu.Unlock()
+		if int(active) == n {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//addActive counts a connection that starts (1) or stops (-1) being handled and wakes up WaitForConnections
+func (s *Server) addActive(delta int64) {
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	s.activeConns.Add(delta)
+	close(s.activeChanged)
+	s.activeChanged = make(chan struct{})
+}
+
+//DroppedMessages returns the number of messages dropped because mCh was full, see: WithBackpressure.
+//It is safe to call while the server is running
+func (s *Server) DroppedMessages() uint64 {
+	return s.fullDrops.Load()
+}
+
+//DedupedMessages returns the number of duplicate messages that weren't persisted, see: WithDedup.
+//It is safe to call while the server is running
+func (s *Server) DedupedMessages() uint64 {
+	return s.deduped.Load()
+}
+
+//PersistedBytes returns the number of message bytes the default handler persisted successfully.
+//It is safe to call while the server is running
+func (s *Server) PersistedBytes() uint64 {
+	return s.persistedBytes.Load()
+}
+
+//EchoedBytes returns the number of bytes the default handler echoed successfully, without the framing.
+//Echoes that stay far behind PersistedBytes (with echoes enabled) mean clients that don't read them.
+//It is safe to call while the server is running
+func (s *Server) EchoedBytes() uint64 {
+	return s.echoedBytes.Load()
+}
+
+//Server holds the configuration of a single echo server.
+//Unlike the package level Run, several servers can live in the same process
+//as long as they listen on different addresses.
+//A Server is meant to be run once.
+type Server struct {
+	network    string
+	addr       string
+	handler    Handler
+	middleware []Middleware
+
+	//extraAddrs are the addresses the server listens on besides addr
+	extraAddrs []string
+	//listeners replace listening on the addresses, see: WithListener
+	listeners []net.Listener
+	//listenControl sets the socket options before binding, see: WithListenControl
+	listenControl func(network, address string, c syscall.RawConn) error
+
+	//mCh is the channel all the TCP handlers are writing to
+	//if it was provided by the user (see: WithMessageChannel)
+	//the user is responsible for draining it
+	mCh     chan []byte
+	ownsMCh bool
+
+	//mChSize is the buffer size of the server's own mCh
+	//consumers is the number of goroutines draining it
+	//consume is called by the consumers with every message, see: WithMessageConsumer
+	mChSize   int
+	consumers int
+	consume   func(msg []byte)
+
+	//backpressure decides what to do with the messages mCh has no room for, counting the dropped ones in fullDrops
+	backpressure Strategy
+	fullDrops    atomic.Uint64
+
+	//persister persists every message, by default to mCh
+	persister           Persister
+	closeOnPersistError bool
+	forwarder           *forwarder
+
+	//framer reads the messages and writes the echoes, by default as lines
+	framer Framer
+	//echoes is unset in persist only mode, see: WithEcho
+	echoes        bool
+	sequencedEcho bool
+	//echoTransform changes the echoes, not what's persisted (see: WithEchoTransform)
+	echoTransform func(msg []byte) []byte
+	validateJSON  bool
+	//strictProtocol closes connections on the first invalid message, see: WithStrictProtocol
+	strictProtocol bool
+	trimCutset     string
+	//persistUnterminated persists the last message of an interrupted connection, see: WithPersistUnterminated
+	persistUnterminated bool
+	//messageHook decides what happens to every message, see: WithMessageHook
+	messageHook func(ctx context.Context, msg []byte) (persist, echo bool, err error)
+	//dedupWindow is how long a connection's duplicate messages aren't persisted, counted in deduped (see: WithDedup)
+	dedupWindow time.Duration
+	deduped     atomic.Uint64
+
+	//pingRequest is answered with pingResponse instead of being persisted, see: WithPingResponder
+	pingRequest  []byte
+	pingResponse []byte
+	//quitCommand closes the connection, after answering it with farewell (see: WithQuitCommand)
+	quitCommand []byte
+	farewell    []byte
+
+	//tooLargeResponse is framed to clients before closing them for sending a message that's too large
+	tooLargeResponse []byte
+	//banner is written to clients before anything they send is read, see: WithBanner
+	banner []byte
+
+	//poolBuffers reuses the scanner buffers across the connections, see: WithBufferPool
+	poolBuffers bool
+	//halfClose ends the connections with a TCP half close, see: WithHalfCloseOnShutdown
+	halfClose bool
+
+	//runDuration is how long Run serves before it shuts down on its own, see: WithRunDuration
+	runDuration time.Duration
+	//shutdownTimeout is how long Run waits for the connections once it's terminating (0 is forever)
+	shutdownTimeout time.Duration
+
+	writeTimeout     time.Duration
+	flushInterval    time.Duration
+	idleTimeout      time.Duration
+	firstByteTimeout time.Duration
+	acceptTimeout    time.Duration
+	maxAcceptBackoff time.Duration
+	keepAlive        time.Duration
+	connTimeout      time.Duration
+
+	//connSlots is a semaphore limiting the number of concurrent connections
+	connSlots    chan struct{}
+	rejectOnFull bool
+	activeConns  atomic.Int64
+	nextConnID   atomic.Uint64
+	//activeChanged is closed and replaced whenever activeConns changes (guarded by activeMu)
+	activeChanged chan struct{}
+	activeMu      sync.Mutex
+
+	//allowList and denyList are the networks clients may (not) connect from
+	allowList []net.IPNet
+	denyList  []net.IPNet
+
+	//connsPerIP counts the connections of every IP, if they are limited (guarded by ipMu)
+	maxConnsPerIP int
+	ipMu          sync.Mutex
+	connsPerIP    map[string]int
+
+	//limits are set by the options and replaced by currentLimits while running (see: SetLimits)
+	//reload loads new limits on SIGHUP, see: WithReloadOnSIGHUP
+	limits            Limits
+	currentLimits     atomic.Pointer[Limits]
+	reload            func() (Limits, error)
+	maxRateViolations int
+
+	maxBytesPerConn int64
+	countBytes      bool
+	compression     Compression
+	webSocket       bool
+	connState       func(conn net.Conn, state ConnState)
+	closeHook       func(info ConnInfo)
+	proxyProtocol   bool
+
+	//conns are the connections being handled, by ID
+	connsMu sync.Mutex
+	conns   map[uint64]*connEntry
+
+	tlsConfig *tls.Config
+	//services are the virtual services by TLS server name, see: WithVirtualServices
+	services map[string]VirtualService
+
+	panicHandler func(conn net.Conn, v interface{})
+
+	logger  *slog.Logger
+	metrics Metrics
+	//acceptLogSampling is n when only 1 of every n connections logs its accept and close, see: WithAcceptLogSampling
+	acceptLogSampling uint64
+
+	ready       chan struct{}
+	onReady     func(addr net.Addr)
+	listenAddrs []net.Addr //guarded by mu
+
+	//shutdown is closed when a graceful shutdown starts (see: Shutdown)
+	//and graceOver when its grace period is over, the connections are interrupted then
+	//stop is closed when the server is stopped (see: Stop)
+	//done is closed when Run returns
+	//handled is closed when the last Serve call returns during the shutdown, see: Done
+	//running is set when Run starts and serving are the running Serve calls (guarded by mu)
+	//closing is set before the server closes its listeners itself
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	graceOver    chan struct{}
+	graceOnce    sync.Once
+	stop         chan struct{}
+	stopOnce     sync.Once
+	done         chan struct{}
+	handled      chan struct{}
+	handledOnce  sync.Once
+	mu           sync.Mutex
+	running      bool
+	serving      map[*serving]struct{}
+	closing      atomic.Bool
+
+	//admin is the address of the debug listener, see: WithAdminAddr
+	//adminAddr is where it listens (guarded by mu)
+	admin     string
+	adminAddr net.Addr
+	//persisted counts the messages persisted successfully,
+	//persistedBytes and echoedBytes what the default handler persisted and echoed successfully
+	persisted      atomic.Uint64
+	persistedBytes atomic.Uint64
+	echoedBytes    atomic.Uint64
+
+	//drained and dropped count the messages handled during a shutdown, see: ShutdownAndReport
+	drained atomic.Int64
+	dropped atomic.Int64
+}
+
+//NewServer creates a Server with the default configuration
+//(listening on :9090, persisting and echoing every message)
+//and applies the given options on top of it.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		network:         "tcp",
+		addr:            ":9090",
+		ownsMCh:         true,
+		consumers:       1,
+		echoes:          true,
+		pingRequest:     []byte("PING"),
+		pingResponse:    []byte("PONG"),
+		quitCommand:     []byte("QUIT"),
+		conns:           make(map[uint64]*connEntry),
+		connsPerIP:      make(map[string]int),
+		activeChanged:   make(chan struct{}),
+		framer:          LineFramer{},
+		poolBuffers:     true,
+		shutdownTimeout: defaultShutdownTimeout,
+		ready:           make(chan struct{}),
+		shutdown:        make(chan struct{}),
+		graceOver:       make(chan struct{}),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+		handled:         make(chan struct{}),
+		serving:         make(map[*serving]struct{}),
+		logger:          slog.Default(),
+		metrics:         noMetrics{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.SetLimits(s.limits)
+	if s.mCh == nil {
+		s.mCh = make(chan []byte, s.mChSize)
+	}
+	if s.consume == nil {
+		s.consume = printMessage
+	}
+	if s.persister == nil && s.backpressure != nil {
+		s.persister = &strategyPersister{mCh: s.mCh, strategy: s.backpressure, dropped: &s.fullDrops}
+	}
+	if s.persister == nil {
+		s.persister = ChannelPersister(s.mCh)
+	}
+	if s.handler == nil {
+		s.handler = func(conn net.Conn, ctx context.Context) error {
+			//supposedly PersistAndEcho is a very important operation
+			//that must not be terminated in the middle
+			//it persists every []byte message (by default to mCh)
+			return s.persistAndEcho(conn, ctx)
+		}
+	}
+	s.handler = Chain(s.handler, s.middleware...)
+	if s.services != nil {
+		//the services are the caller's, they get their own copy of the chained handlers
+		services := make(map[string]VirtualService, len(s.services))
+		for name, service := range s.services {
+			if service.Handler != nil {
+				service.Handler = Chain(service.Handler, s.middleware...)
+			}
+			services[name] = service
+		}
+		s.services = services
+	}
+	return s
+}
+
+//printMessage is the default message consumer
+func printMessage(msg []byte) {
+	fmt.Println("Received message:", string(msg))
+}
+
+//Ready returns a channel that is closed once the server is listening.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+//Addr returns the address the server is listening on,
+//which is useful when listening on port 0. It is nil until the server is ready
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listenAddrs) == 0 {
+		return nil
+	}
+	return s.listenAddrs[0]
+}
+
+//Addrs returns all the addresses the server is listening on,
+//starting with Addr and followed by the ones added with WithListenAddr
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]net.Addr(nil), s.listenAddrs...)
+}
+
+//Run is kept for backwards compatibility.
+//It runs a Server with the default configuration on addr, see: Server.Run
+//ready isn't closed if the server can't listen
+func Run(addr string, ready chan struct{}, ctx context.Context) error {
+	return NewServer(WithAddr(addr), withReady(ready)).Run(ctx)
+}
+
+//Run listens on the server's address and serves connections until ctx is cancelled.
+//A ctx deadline ends it just the same, interrupting the connections when it passes.
+//It returns after all the connections were handled and all the messages were consumed.
+//It returns an error if the server can't listen, see: ListenAndServe
+func (s *Server) Run(ctx context.Context) error {
+	return s.ListenAndServe(ctx)
+}
+
+//ListenAndServe listens on the server's address and serves connections until ctx is cancelled
+//or the server is shut down (see: Shutdown).
+//It returns after all the connections were handled and all the messages were consumed,
+//nil after a clean shutdown and the error otherwise, e.g. when the server can't listen
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	defer close(s.done)
+	//Stop cancels ctx for us
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if s.runDuration > 0 {
+		var cancelRun context.CancelFunc
+		ctx, cancelRun = context.WithTimeout(ctx, s.runDuration)
+		defer cancelRun()
+	}
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	s.mu.Lock()
+	s.running = true
+	s.mu.Unlock()
+
+	//datagram networks are served with ServePacket instead of Serve
+	var ls []net.Listener
+	var pcs []net.PacketConn
+	var err error
+	if isPacketNetwork(s.network) {
+		pcs, err = s.listenAllPacket()
+	} else {
+		ls, err = s.listenAll()
+	}
+	if err != nil {
+		return err
+	}
+	admin, err := s.listenAdmin()
 	if err != nil {
-		panic(err)
+		for _, l := range ls {
+			l.Close()
+		}
+		for _, pc := range pcs {
+			pc.Close()
+		}
+		return err
+	}
+	var closers []io.Closer
+	s.mu.Lock()
+	for i := range ls {
+		//both goroutine 1 and Shutdown may close the listeners
+		ls[i] = &onceCloseListener{Listener: ls[i]}
+		s.listenAddrs = append(s.listenAddrs, ls[i].Addr())
+		closers = append(closers, ls[i])
+	}
+	for _, pc := range pcs {
+		s.listenAddrs = append(s.listenAddrs, pc.LocalAddr())
+		closers = append(closers, pc)
 	}
-	close(ready)      //signal that we are listening
+	addrs := append([]net.Addr(nil), s.listenAddrs...)
+	s.mu.Unlock()
+	if s.onReady != nil {
+		for _, addr := range addrs {
+			s.onReady(addr)
+		}
+	}
+	if s.reload != nil {
+		s.reloadOnSIGHUP()
+	}
+	close(s.ready)    //signal that we are listening, Addr is already set
 	runtime.Gosched() //not necessary - ensures the "listening" log message is first
 
 	var wg sync.WaitGroup
-	wg.Add(2)
+	wg.Add(1)
+	if admin != nil {
+		//the admin listener outlives the others, it's how we find out why the termination hangs
+		adminDone := make(chan struct{})
+		go func() {
+			defer close(adminDone)
+			s.serveAdmin(admin)
+		}()
+		defer func() {
+			admin.Close()
+			<-adminDone
+		}()
+	}
 
 	//goroutine 1:
 	//handle context cancellation
-	//It starts the termination process by closing the listener
+	//It starts the termination process by closing the listeners
 	//wg.Done is not necessary here, since it terminates the others
+	//graceful shutdown also starts here, but leaves the connections alone
+	//terminating is closed once it starts, the shutdown timeout starts with it
+	//unless graceful is set, then it starts once the grace period is over
+	terminating := make(chan struct{})
+	var graceful bool
 	go func() {
-		<-ctx.Done()
-		log.Println("Context cancelled. Terminating...")
-		if err := l.Close(); err != nil {
-			panic(err)
+		select {
+		case <-ctx.Done():
+			//ctx.Err() tells a cancellation from a deadline
+			s.logger.Info("Context cancelled. Terminating...", "err", ctx.Err())
+		case <-s.shutdown:
+			s.logger.Info("Shutting down. Terminating...")
+			graceful = true
 		}
+		s.closing.Store(true)
+		for _, l := range closers {
+			//nothing we can do about it, and we're done with the listener anyway
+			if err := l.Close(); err != nil {
+				s.logger.Warn("Closing the listener failed", "err", err)
+			}
+		}
+		close(terminating)
 	}()
 
-	mCh := make(chan []byte)
+	mCh := s.mCh
+	var serveErr error //set by goroutine 2 before it's done
 	//goroutine 2:
 	//Serve: Accepts connections and spawns goroutines to handle them
 	//Serve exists when l.Accept fails (we trigger this behavior by closing
 	//the listener in goroutine 1
+	//With several listeners (see: WithListenAddr) there's a Serve per listener
+	//and goroutine 2 waits for all of them
 	//Since it exists after all goroutines have finished writing to our shared
 	//message channel mCh, we can close mCh, thereby causing the graceful termination
 	//of goroutine 3
@@ -100,33 +1165,300 @@ func Run(addr string, ready chan struct{}, ctx context.Context) {
 		defer func() {
 			//Serve finishes only when all messages
 			//have been persisted, we can safely close mCh
-			log.Println("Serve finished. Terminating...")
+			s.logger.Info("Serve finished. Terminating...")
 			close(mCh)
 			wg.Done()
 		}()
 
-		Serve(l, ctx, func(conn net.Conn, ctx context.Context) {
-			//supposedly PersistAndEcho is a very important operation
-			//that must not be terminated in the middle
-			//it writes []byte message to mCh
-			PersistAndEcho(mCh, conn, ctx)
-		})
+		serveErr = s.serveAll(ls, pcs, ctx)
 	}()
 
 	//goroutine 3:
 	//Iterate over mCh (the channels all the TCP handlers are writing to
 	//It exists when mCh is closed (see: goroutine 2)
-	go func() {
-		defer func() {
-			log.Println("Messages channel closed. Terminating...")
-			wg.Done()
-		}()
-		for m := range mCh {
-			fmt.Println("Received message:", string(m))
+	//If mCh was provided by the user, draining it is up to them
+	//With several consumers (see: WithConsumerWorkers) there's one goroutine 3 per consumer
+	if s.ownsMCh {
+		for i := 0; i < s.consumers; i++ {
+			wg.Add(1)
+			go func() {
+				defer func() {
+					s.logger.Info("Messages channel closed. Terminating...")
+					wg.Done()
+				}()
+				for m := range mCh {
+					s.consume(m)
+				}
+			}()
 		}
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
 	}()
+	select {
+	case <-finished:
+		return serveErr
+	case <-terminating:
+	}
+	if graceful {
+		//Shutdown's context decides how long the connections get, see: Shutdown
+		select {
+		case <-finished:
+			return serveErr
+		case <-s.graceOver:
+		case <-ctx.Done():
+		}
+	}
+	if s.shutdownTimeout <= 0 {
+		<-finished
+		return serveErr
+	}
+	timer := time.NewTimer(s.shutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-finished:
+		return serveErr
+	case <-timer.C:
+	}
+	//a stuck handler must not keep the process alive,
+	//whatever is still running is abandoned and mCh is left open for it
+	s.logger.Error("Shutdown timed out, closing the remaining connections",
+		"timeout", s.shutdownTimeout, "connections", s.ActiveConnections())
+	s.closeAll()
+	return ErrShutdownTimeout
+}
 
+//serveAll runs Serve on every listener and ServePacket on every packet connection,
+//waits for all of them and returns the first error
+func (s *Server) serveAll(ls []net.Listener, pcs []net.PacketConn, ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(ls)+len(pcs))
+	for _, l := range ls {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			errs <- s.Serve(l, ctx)
+		}(l)
+	}
+	for _, pc := range pcs {
+		wg.Add(1)
+		go func(pc net.PacketConn) {
+			defer wg.Done()
+			errs <- s.ServePacket(pc, ctx)
+		}(pc)
+	}
 	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Shutdown gracefully shuts the server down without interrupting any message in the middle.
+//It stops accepting new connections and lets the connections being handled
+//finish reading, persisting and echoing their current message.
+//Messages that were already received but not handled yet are handled too,
+//connections waiting for their next message are done right away.
+//If ctx is done first, the remaining connections are interrupted just like
+//when Run's context is cancelled and ctx.Err() is returned.
+//Run's shutdown timeout only starts then (see: WithShutdownTimeout).
+//It stops both Run and the Serve calls of the server, closing their listeners.
+//It's safe to call it more than once and together with cancelling Run's context,
+//the listeners are only closed once
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closing.Store(true)
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
+	s.mu.Lock()
+	running := s.running
+	served := make([]*serving, 0, len(s.serving))
+	for sv := range s.serving {
+		served = append(served, sv)
+	}
+	s.mu.Unlock()
+	for _, sv := range served {
+		sv.l.Close()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		for _, sv := range served {
+			<-sv.done
+		}
+		if running {
+			<-s.done
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+	}
+	s.graceOnce.Do(func() {
+		close(s.graceOver)
+	})
+	for _, sv := range served {
+		sv.cancel()
+	}
+	<-finished
+	return ctx.Err()
+}
+
+//Stop stops the server just like cancelling Run's context does:
+//it closes the listeners, interrupts the connections being handled
+//and returns after the messages that were already received were consumed.
+//It stops both Run and the Serve calls of the server, and a Run that starts
+//after Stop returns right away. It's safe to call it more than once
+func (s *Server) Stop() {
+	s.StopContext(context.Background())
+}
+
+//StopContext stops the server like Stop, but gives up waiting
+//when ctx is done first and returns ctx.Err()
+func (s *Server) StopContext(ctx context.Context) error {
+	s.closing.Store(true)
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	s.mu.Lock()
+	running := s.running
+	served := make([]*serving, 0, len(s.serving))
+	for sv := range s.serving {
+		served = append(served, sv)
+	}
+	s.mu.Unlock()
+	for _, sv := range served {
+		sv.cancel()
+		sv.l.Close()
+	}
+
+	for _, sv := range served {
+		select {
+		case <-sv.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if running {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+//serving is a running Serve call, see: Shutdown
+type serving struct {
+	l      io.Closer          //the listener or packet connection
+	cancel context.CancelFunc //interrupts all the connections
+	done   chan struct{}
+}
+
+//startServing registers a Serve (or ServePacket) call on l so Shutdown can stop it
+func (s *Server) startServing(l io.Closer, cancel context.CancelFunc) *serving {
+	sv := &serving{l: l, cancel: cancel, done: make(chan struct{})}
+	s.mu.Lock()
+	s.serving[sv] = struct{}{}
+	s.mu.Unlock()
+	if s.shuttingDown() || s.stopping() {
+		//Shutdown or Stop may have missed us
+		l.Close()
+	}
+	if s.stopping() {
+		cancel()
+	}
+	return sv
+}
+
+func (s *Server) stopServing(sv *serving) {
+	s.mu.Lock()
+	delete(s.serving, sv)
+	last := len(s.serving) == 0
+	s.mu.Unlock()
+	close(sv.done)
+	if last {
+		//nothing is left to forward, and its upstream connection goes with it
+		s.stopForwarder()
+	}
+	if last && s.closing.Load() {
+		s.handledOnce.Do(func() {
+			close(s.handled)
+		})
+	}
+}
+
+//Done returns a channel that's closed once the server was shut down (see: Run and Shutdown)
+//and all its connection handlers have returned.
+//Unlike waiting for Run, it doesn't wait for the message consumers,
+//e.g. to close a Persister only after every handler is done with it
+func (s *Server) Done() <-chan struct{} {
+	return s.handled
+}
+
+//onceCloseListener ignores all but the first Close
+type onceCloseListener struct {
+	net.Listener
+	once sync.Once
+}
+
+//SetDeadline sets the accept deadline of the listener, if it supports one, see: WithAcceptTimeout
+func (l *onceCloseListener) SetDeadline(t time.Time) error {
+	if d, ok := l.Listener.(acceptDeadliner); ok {
+		return d.SetDeadline(t)
+	}
+	return nil
+}
+
+//acceptDeadliner is a listener with an accept deadline, like *net.TCPListener
+type acceptDeadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+func (l *onceCloseListener) Close() (err error) {
+	l.once.Do(func() {
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	select {
+	case <-s.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) stopping() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+//waitForShutdown waits for any of the signals and cancels the context
+func waitForShutdown(cancel context.CancelFunc, signals ...os.Signal) {
+	//create a channel for singals, and register for them.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, signals...)
+	defer signal.Stop(sigc)
+
+	sig := <-sigc
+	slog.Info("Received signal... Canceling the context", "signal", sig)
+	cancel()
 }
 
 func main() {
@@ -136,28 +1468,24 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	//create a channel for singals, and register for signal interrupt.
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, syscall.SIGINT)
-
-	go func() {
-		//upon receiving sigint, cancel the context
-		//if everything is done properly, the program will terminate gracefully
-		//if not, the prorgam will not exit and you will have to kill it.
-		<-sigc
-		log.Println("Received SIGINT... Canceling the context")
-		cancel()
-	}()
+	//upon receiving SIGINT (ctrl+c) or SIGTERM (systemd, kubernetes), cancel the context
+	//if everything is done properly, the program will terminate gracefully
+	//if not, Run gives up on the connections after the shutdown timeout (see: WithShutdownTimeout)
+	go waitForShutdown(cancel, syscall.SIGINT, syscall.SIGTERM)
 
 	done := make(chan struct{})
 	ready := make(chan struct{})
 
 	go func() {
-		Run(addr, ready, ctx)
+		if err := Run(addr, ready, ctx); err != nil {
+			//either we never got ready or the shutdown timed out, don't wait for anything
+			slog.Error("Server failed", "err", err)
+			os.Exit(1)
+		}
 		close(done)
 	}()
 
 	<-ready //our signal from inside Run that the app is ready.
-	log.Println("App is ready to accept connections")
+	slog.Info("App is ready to accept connections")
 	<-done //our signal that Run has finished and we can exit.
 }
@@ -5,11 +5,33 @@ import (
 	"context"
 	"net"
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"flag"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-const addr = ":9090"
+//addr lets the OS pick a free port, so tests never collide on a fixed one
+const addr = "127.0.0.1:0"
 const message = "sup?"
 
+//TestMain keeps the servers of the tests quiet unless we run with -v
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.DiscardHandler))
+	}
+	os.Exit(m.Run())
+}
+
 //This test shows Run terminates when the context is cancelled.
 func TestRun(t *testing.T) {
 	//iterating ensures we are releasing all the resources we are using
@@ -21,13 +43,14 @@ func TestRun(t *testing.T) {
 
 		finished := make(chan struct{})
 
+		s := NewServer(WithAddr(addr), withReady(ready)) //what Run(addr, ready, ctx) does
 		go func() {
-			Run(addr, ready, ctx)
+			s.Run(ctx)
 			close(finished)
 		}()
 
 		<-ready //try removing this line
-		conn, err := net.Dial("tcp", addr)
+		conn, err := net.Dial("tcp", s.Addr().String())
 		if err != nil {
 			//cleanup resources to not affect other tests
 			cancel()
@@ -41,13 +64,13 @@ func TestRun(t *testing.T) {
 		}
 
 		//get your message back
-		s, err := bufio.NewReader(conn).ReadString('\n')
+		echo, err := bufio.NewReader(conn).ReadString('\n')
 		if err != nil {
 			t.Error(err)
 		}
 
-		if s != message+"\n" {
-			t.Errorf("Expected '%s' but received '%s'", message, s)
+		if echo != message+"\n" {
+			t.Errorf("Expected '%s' but received '%s'", message, echo)
 		}
 
 		conn.Close()
@@ -70,18 +93,18 @@ func TestServe(t *testing.T) {
 		finished := make(chan struct{})
 		ready := make(chan struct{})
 
-		handler := func(conn net.Conn, ctx context.Context) {
+		handler := NoError(func(conn net.Conn, ctx context.Context) {
 			close(ready)
 			conn.Write([]byte(message + "\n"))
 			<-ctx.Done() //block until cancel() to ensure it is called within the test
-		}
+		})
 
 		go func() {
 			Serve(l, ctx, handler)
 			close(finished)
 		}()
 
-		conn, err := net.Dial("tcp", addr)
+		conn, err := net.Dial("tcp", l.Addr().String())
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -115,7 +138,7 @@ func TestPersistAndEcho(t *testing.T) {
 	}
 	defer l.Close()
 
-	cliConn, err := net.Dial("tcp", addr)
+	cliConn, err := net.Dial("tcp", l.Addr().String())
 	if err != nil {
 		t.Fatal()
 	}
@@ -157,3 +180,2007 @@ func TestPersistAndEcho(t *testing.T) {
 	//	}()
 	//}
 }
+
+//This test shows two independent servers can run concurrently in the same process.
+func TestServerRunConcurrently(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var servers []*Server
+	var chans []chan []byte
+	finished := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		mCh := make(chan []byte)
+		s := NewServer(WithAddr("127.0.0.1:0"), WithMessageChannel(mCh))
+		servers = append(servers, s)
+		chans = append(chans, mCh)
+		go func() {
+			s.Run(ctx)
+			finished <- struct{}{}
+		}()
+	}
+
+	for i, s := range servers {
+		<-s.Ready()
+		addr := s.Addr().String()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte(addr + "\n")); err != nil {
+			t.Error(err)
+		}
+		//every server persists to its own channel
+		if m := <-chans[i]; string(m) != addr {
+			t.Errorf("Expected '%s' but received '%s'", addr, string(m))
+		}
+		echo, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Error(err)
+		}
+		if echo != addr+"\n" {
+			t.Errorf("Expected '%s' but received '%s'", addr, echo)
+		}
+		conn.Close()
+	}
+
+	cancel()
+	for i := range servers {
+		//the servers close the channels we provided once they are done
+		for range chans[i] {
+		}
+		<-finished
+	}
+}
+
+//handleConn handles conn with the default handler and closes it after, like Serve does
+func (s *Server) handleConn(conn net.Conn, ctx context.Context) error {
+	defer s.closeHandled(conn, ctx)
+	return s.persistAndEcho(conn, ctx)
+}
+
+//tcpPair returns the two ends of a TCP connection on a random port
+func tcpPair(t *testing.T) (cliConn, servConn net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cliConn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	servConn, err = l.Accept()
+	if err != nil {
+		cliConn.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cliConn.Close()
+		servConn.Close()
+	})
+	return cliConn, servConn
+}
+
+//This test shows lines longer than the default 64KB are accepted with WithMaxLineSize
+//and that lines exceeding the maximum terminate the handler with bufio.ErrTooLong
+func TestPersistAndEchoMaxLineSize(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte)
+	s := NewServer(WithMessageChannel(mCh), WithMaxLineSize(128*1024))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.persistAndEcho(servConn, ctx)
+	}()
+
+	long := strings.Repeat("a", 100*1024)
+	go cliConn.Write([]byte(long + "\n"))
+	if m := <-mCh; string(m) != long {
+		t.Fatalf("Expected a message of %d bytes but received %d bytes", len(long), len(m))
+	}
+	echo, err := bufio.NewReaderSize(cliConn, 128*1024).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if echo != long+"\n" {
+		t.Fatalf("Expected an echo of %d bytes but received %d bytes", len(long)+1, len(echo))
+	}
+
+	go cliConn.Write([]byte(strings.Repeat("a", 200*1024) + "\n"))
+	if err := <-errCh; err != bufio.ErrTooLong {
+		t.Fatalf("Expected '%v' but received '%v'", bufio.ErrTooLong, err)
+	}
+}
+
+//This test shows PersistAndEcho tells apart a client closing the connection from a read error.
+func TestPersistAndEchoErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cliConn, servConn := tcpPair(t)
+	cliConn.Close()
+	if err := PersistAndEcho(make(chan []byte), servConn, ctx); err != nil {
+		t.Fatalf("Expected no error when the client closes the connection but received '%v'", err)
+	}
+
+	_, servConn = tcpPair(t)
+	servConn.SetReadDeadline(time.Now()) //fail the read without cancelling the context
+	err := PersistAndEcho(make(chan []byte), servConn, ctx)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("Expected a timeout error but received '%v'", err)
+	}
+}
+
+//syncBuffer is a bytes.Buffer that is safe to read
+//while goroutines from other tests keep logging to it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+//This test shows Serve logs the errors returned by the handler
+//with the connection's ID and remote address.
+func TestServeHandlerError(t *testing.T) {
+	var buf syncBuffer
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan struct{})
+	finished := make(chan struct{})
+	s := NewServer(
+		WithLogger(slog.New(slog.NewTextHandler(&buf, nil))),
+		WithHandler(func(conn net.Conn, ctx context.Context) error {
+			defer close(handled)
+			return errors.New("handler failed")
+		}),
+	)
+	go func() {
+		s.Serve(l, context.Background())
+		close(finished)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-handled
+	l.Close()
+	<-finished //Serve waits for the handler's cleanup, including the log
+
+	expected := `msg="Handler failed" conn=1 remote=` + conn.LocalAddr().String() + ` err="handler failed"`
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatalf("Expected the log to contain '%s' but received '%s'", expected, buf.String())
+	}
+}
+
+//This test shows a client that never reads its echoes can't block the handler forever.
+func TestPersistAndEchoWriteTimeout(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte)
+	s := NewServer(WithMessageChannel(mCh), WithWriteTimeout(100*time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		for range mCh {
+		}
+	}()
+	go func() {
+		//keep writing without ever reading until the server gives up on us
+		line := []byte(strings.Repeat("a", 1024) + "\n")
+		for {
+			if _, err := cliConn.Write(line); err != nil {
+				return
+			}
+		}
+	}()
+
+	err := s.persistAndEcho(servConn, ctx)
+	close(mCh)
+	if !isTimeout(err) {
+		t.Fatalf("Expected a timeout error but received '%v'", err)
+	}
+}
+
+//failingWriteConn fails every write with err
+type failingWriteConn struct {
+	net.Conn
+	err error
+}
+
+func (c *failingWriteConn) Write(p []byte) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "tcp", Err: c.err}
+}
+
+//This test shows a client that closes the connection before reading its echo stops the handler without an error,
+//while other write errors are returned.
+func TestPersistAndEchoWriteAfterPeerClose(t *testing.T) {
+	for _, tc := range []struct {
+		writeErr error
+		clean    bool
+	}{
+		{os.NewSyscallError("write", syscall.EPIPE), true},
+		{os.NewSyscallError("write", syscall.ECONNRESET), true},
+		{errors.New("disk on fire"), false},
+	} {
+		cliConn, servConn := tcpPair(t)
+		var logs syncBuffer
+		p := &recordingPersister{}
+		s := NewServer(WithPersister(p), WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s.persistAndEcho(&failingWriteConn{Conn: servConn, err: tc.writeErr}, context.Background())
+		}()
+		//the second message is never read, the handler stops at the first echo
+		cliConn.Write([]byte(message + "\n" + message + "\n"))
+
+		var err error
+		select {
+		case err = <-errCh:
+		case <-time.After(time.Second):
+			t.Fatal("Expected the handler to stop")
+		}
+		if n := len(p.messages()); n != 1 {
+			t.Fatalf("Expected 1 message to be persisted but received %d", n)
+		}
+		if tc.clean {
+			if err != nil || strings.Contains(logs.String(), "level=WARN") || strings.Contains(logs.String(), "level=ERROR") {
+				t.Fatalf("Expected a clean close for '%v' but received '%v':\n%s", tc.writeErr, err, logs.String())
+			}
+			if !strings.Contains(logs.String(), "reason=client_eof") {
+				t.Fatalf("Expected the close reason to be logged but received:\n%s", logs.String())
+			}
+		} else if !errors.Is(err, tc.writeErr) || !strings.Contains(logs.String(), "reason=write_error") {
+			t.Fatalf("Expected '%v' for a write error but received '%v':\n%s", tc.writeErr, err, logs.String())
+		}
+	}
+}
+
+//This test shows idle connections are closed after the idle timeout,
+//while active connections are kept open and cancellation still interrupts them.
+func TestPersistAndEchoIdleTimeout(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte)
+	s := NewServer(WithMessageChannel(mCh), WithIdleTimeout(200*time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.persistAndEcho(servConn, ctx)
+	}()
+
+	//we stay active for longer than the idle timeout
+	r := bufio.NewReader(cliConn)
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		cliConn.Write([]byte(message + "\n"))
+		<-mCh
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	if err := <-errCh; err != nil {
+		t.Fatalf("Expected no error on idle timeout but received '%v'", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected the connection to be closed after the idle timeout but it took %v", d)
+	}
+
+	//the idle deadline doesn't override the cancellation deadline
+	_, servConn = tcpPair(t)
+	s = NewServer(WithMessageChannel(mCh), WithIdleTimeout(time.Hour))
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		errCh <- s.persistAndEcho(servConn, ctx)
+	}()
+	cancel()
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the cancellation to interrupt the idle connection")
+	}
+}
+
+//This test shows a connection that doesn't send anything is closed after the first byte timeout,
+//while a client that started sending has all the time it needs.
+func TestPersistAndEchoFirstByteTimeout(t *testing.T) {
+	var logs syncBuffer
+	s := NewServer(WithPersister(&recordingPersister{}), WithFirstByteTimeout(50*time.Millisecond),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	cliConn, servConn := tcpPair(t)
+	errCh := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		errCh <- s.handleConn(servConn, context.Background())
+	}()
+	if err := <-errCh; err != nil {
+		t.Fatalf("Expected no error on the first byte timeout but received '%v'", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected the connection to be closed after the first byte timeout but it took %v", d)
+	}
+	if _, err := cliConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed but received '%v'", err)
+	}
+	if !strings.Contains(logs.String(), "Idle handshake timeout") {
+		t.Fatalf("Expected the timeout to be logged but received:\n%s", logs.String())
+	}
+
+	//the first byte clears the deadline, the rest of the message may take longer
+	cliConn, servConn = tcpPair(t)
+	go func() {
+		errCh <- s.handleConn(servConn, context.Background())
+	}()
+	r := bufio.NewReader(cliConn)
+	cliConn.Write([]byte(message[:1]))
+	time.Sleep(100 * time.Millisecond)
+	cliConn.Write([]byte(message[1:] + "\n"))
+	if echo := mustReadLine(t, r); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s'", message, echo)
+	}
+	time.Sleep(100 * time.Millisecond)
+	cliConn.Write([]byte(message + "\n"))
+	if echo := mustReadLine(t, r); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s'", message, echo)
+	}
+	cliConn.Close()
+	if err := <-errCh; err != nil {
+		t.Fatalf("Expected the client to close the connection but received '%v'", err)
+	}
+}
+
+//This test shows Shutdown lets connections finish their current message
+//and interrupts them once the grace period is over.
+func TestServerShutdown(t *testing.T) {
+	s := NewServer(WithAddr("127.0.0.1:0"))
+	finished := make(chan struct{})
+	go func() {
+		s.Run(context.Background())
+		close(finished)
+	}()
+	<-s.Ready()
+	addr := s.Addr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte(message + "\n"))
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	//the current message
+	conn.Write([]byte(message[:1]))
+	time.Sleep(50 * time.Millisecond)
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+
+	//the server is no longer accepting connections, but our message is still handled
+	time.Sleep(50 * time.Millisecond)
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatal("Expected the server to stop accepting connections")
+	}
+	conn.Write([]byte(message[1:] + "\n"))
+	if echo, err := r.ReadString('\n'); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s' (%v)", message, echo, err)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Expected a graceful shutdown but received '%v'", err)
+	}
+	<-finished
+
+	//a connection that doesn't finish its message is interrupted after the grace period
+	s = NewServer(WithAddr("127.0.0.1:0"))
+	go func() {
+		s.Run(context.Background())
+	}()
+	<-s.Ready()
+	stuck, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	//make sure the connection is being handled before it gets stuck
+	stuck.Write([]byte(message + "\n"))
+	if _, err := bufio.NewReader(stuck).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	stuck.Write([]byte(message[:1]))
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected '%v' but received '%v'", context.DeadlineExceeded, err)
+	}
+}
+
+//This test shows WithMaxConnections either queues or rejects connections over the limit.
+func TestServeMaxConnections(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		handling := make(chan struct{})
+		release := make(chan struct{})
+		s := NewServer(WithMaxConnections(1), WithRejectOnFull(reject), WithHandler(NoError(func(conn net.Conn, ctx context.Context) {
+			handling <- struct{}{}
+			<-release
+			conn.Write([]byte(message + "\n"))
+		})))
+		finished := make(chan struct{})
+		go func() {
+			s.Serve(l, context.Background())
+			close(finished)
+		}()
+
+		first, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-handling
+		second, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-handling:
+			t.Fatal("Expected the second connection not to be handled while the first one is")
+		case <-time.After(100 * time.Millisecond):
+		}
+		if reject {
+			//the rejected connection is closed without being handled
+			if _, err := bufio.NewReader(second).ReadString('\n'); err != io.EOF {
+				t.Fatalf("Expected '%v' but received '%v'", io.EOF, err)
+			}
+			release <- struct{}{}
+		} else {
+			//the second connection is handled once the first one is done
+			release <- struct{}{}
+			<-handling
+			release <- struct{}{}
+		}
+
+		first.Close()
+		second.Close()
+		l.Close()
+		<-finished
+	}
+}
+
+//This test shows ActiveConnections follows the connections being handled.
+func TestServerActiveConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handling := make(chan struct{})
+	s := NewServer(WithHandler(NoError(func(conn net.Conn, ctx context.Context) {
+		handling <- struct{}{}
+		<-ctx.Done()
+	})))
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, ctx)
+		close(finished)
+	}()
+
+	for i := 1; i <= 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		<-handling
+		if n := s.ActiveConnections(); n != i {
+			t.Fatalf("Expected %d active connections but received %d", i, n)
+		}
+	}
+
+	l.Close()
+	cancel()
+	<-finished
+	if n := s.ActiveConnections(); n != 0 {
+		t.Fatalf("Expected no active connections but received %d", n)
+	}
+}
+
+//This test shows WaitForConnections returns once the connections are being handled, and once they're gone.
+func TestWaitForConnections(t *testing.T) {
+	s := NewServer(WithAddr(addr), WithPersister(&recordingPersister{}))
+	runCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go s.Run(runCtx)
+	<-s.Ready()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	if err := s.WaitForConnections(ctx, 3); err != nil {
+		t.Fatalf("Expected 3 active connections but received '%v' with %d", err, s.ActiveConnections())
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if err := s.WaitForConnections(ctx, 0); err != nil {
+		t.Fatalf("Expected no active connections but received '%v' with %d", err, s.ActiveConnections())
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	if err := s.WaitForConnections(short, 1); err != context.DeadlineExceeded {
+		t.Fatalf("Expected '%v' but received '%v'", context.DeadlineExceeded, err)
+	}
+}
+
+//This test shows the messages written to mCh are not overwritten
+//by the following messages of the same connection.
+func TestPersistAndEchoPipelined(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		PersistAndEcho(mCh, servConn, ctx)
+		close(mCh)
+	}()
+	go io.Copy(io.Discard, cliConn)
+
+	//enough lines for the scanner to reuse its buffer
+	const n = 200
+	var lines bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&lines, "%s %03d %s\n", message, i, strings.Repeat("x", 64))
+	}
+	go cliConn.Write(lines.Bytes())
+
+	//hold on to all the messages before looking at them
+	var msgs [][]byte
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, <-mCh)
+	}
+	for i, m := range msgs {
+		if expected := fmt.Sprintf("%s %03d %s", message, i, strings.Repeat("x", 64)); string(m) != expected {
+			t.Fatalf("Expected '%s' but received '%s'", expected, m)
+		}
+	}
+}
+
+//This test shows Addr reports the port assigned by the OS once the server is ready.
+func TestServerAddr(t *testing.T) {
+	s := NewServer(WithAddr("127.0.0.1:0"))
+	if s.Addr() != nil {
+		t.Fatalf("Expected no address before the server is ready but received '%v'", s.Addr())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(finished)
+	}()
+	<-s.Ready()
+
+	addr, ok := s.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("Expected the OS assigned port but received '%v'", s.Addr())
+	}
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	cancel()
+	<-finished
+}
+
+//This test shows a panicking handler only closes its own connection.
+func TestServePanic(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	panics := make(chan interface{}, 1)
+	s := NewServer(
+		WithHandler(NoError(func(conn net.Conn, ctx context.Context) {
+			r := bufio.NewReader(conn)
+			if line, _ := r.ReadString('\n'); line == "panic\n" {
+				panic("bad client")
+			}
+			conn.Write([]byte(message + "\n"))
+		})),
+		WithPanicHandler(func(conn net.Conn, v interface{}) {
+			panics <- v
+		}),
+	)
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, context.Background())
+		close(finished)
+	}()
+
+	bad, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	bad.Write([]byte("panic\n"))
+	if v := <-panics; v != "bad client" {
+		t.Fatalf("Expected the panic handler to receive 'bad client' but received '%v'", v)
+	}
+	if _, err := bufio.NewReader(bad).ReadString('\n'); err != io.EOF {
+		t.Fatalf("Expected the panicking connection to be closed but received '%v'", err)
+	}
+
+	//the server keeps serving other connections
+	good, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer good.Close()
+	good.Write([]byte("hi\n"))
+	if echo, err := bufio.NewReader(good).ReadString('\n'); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s' (%v)", message, echo, err)
+	}
+	l.Close()
+	<-finished
+}
+
+//This test shows cancelling the context twice, and shutting down on top of it,
+//closes the listener once and terminates the server cleanly.
+func TestShutdownTwice(t *testing.T) {
+	var logs syncBuffer
+	s := NewServer(WithAddr("127.0.0.1:0"), WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Run(ctx)
+	}()
+	<-s.Ready()
+
+	cancel()
+	cancel()
+	shutdownErrs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			shutdownErrs <- s.Shutdown(context.Background())
+		}()
+	}
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Expected a clean termination but received '%v'", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the server to terminate")
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-shutdownErrs; err != nil {
+			t.Fatalf("Expected Shutdown to succeed but received '%v'", err)
+		}
+	}
+	if strings.Contains(logs.String(), "Closing the listener failed") {
+		t.Fatalf("Expected the listener to be closed once but received:\n%s", logs.String())
+	}
+}
+
+//This test shows the deadline of Run's context interrupts the connections when it passes.
+func TestRunDeadline(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	var logs syncBuffer
+	s := NewServer(WithAddr(addr), WithPersister(&recordingPersister{}), WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Run(ctx)
+	}()
+	<-s.Ready()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte(message + "\n"))
+	mustReadLine(t, r)
+
+	//the connection is idle, waiting for the next message
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed but received '%v'", err)
+	}
+	if closed := time.Now(); closed.Before(deadline) || closed.After(deadline.Add(500*time.Millisecond)) {
+		t.Fatalf("Expected the connection to be closed at the deadline %v but it was closed at %v", deadline, closed)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Expected a clean termination but received '%v'", err)
+	}
+	if !strings.Contains(logs.String(), "context deadline exceeded") {
+		t.Fatalf("Expected the deadline to be logged but received:\n%s", logs.String())
+	}
+}
+
+//This test shows Done is closed after cancelling the context,
+//once the connections were handled.
+func TestDone(t *testing.T) {
+	var handled atomic.Bool
+	s := NewServer(WithAddr("127.0.0.1:0"), WithMiddleware(func(next Handler) Handler {
+		return func(conn net.Conn, ctx context.Context) error {
+			err := next(conn, ctx)
+			time.Sleep(10 * time.Millisecond)
+			handled.Store(true)
+			return err
+		}
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Run(ctx)
+	<-s.Ready()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(message + "\n"))
+	mustReadLine(t, bufio.NewReader(conn))
+
+	select {
+	case <-s.Done():
+		t.Fatal("Expected Done to wait for the shutdown")
+	default:
+	}
+	cancel()
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected Done to be closed")
+	}
+	if !handled.Load() {
+		t.Fatal("Expected the handler to return before Done is closed")
+	}
+}
+
+//This test shows Shutdown also stops a server driven by Serve.
+func TestServeShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handling := make(chan struct{})
+	s := NewServer(WithHandler(NoError(func(conn net.Conn, ctx context.Context) {
+		handling <- struct{}{}
+		<-ctx.Done() //only the grace period expiring gets us out
+	})))
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Serve(l, context.Background())
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-handling
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected '%v' but received '%v'", context.DeadlineExceeded, err)
+	}
+	//a shutdown isn't a failure
+	if err := <-serveErr; err != nil {
+		t.Fatalf("Expected Serve to return no error but received '%v'", err)
+	}
+	if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		c.Close()
+		t.Fatal("Expected the listener to be closed")
+	}
+}
+
+//This test shows a line of exactly the maximum size is accepted.
+func TestPersistAndEchoExactMaxLineSize(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte)
+	s := NewServer(WithMessageChannel(mCh), WithMaxLineSize(100))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	line := strings.Repeat("a", 100)
+	cliConn.Write([]byte(line + "\r\n"))
+	if m := <-mCh; string(m) != line {
+		t.Fatalf("Expected a message of %d bytes but received %d bytes", len(line), len(m))
+	}
+}
+
+//This test shows handlers don't wait for the consumer until the message buffer is full.
+func TestPersistAndEchoMessageBufferSize(t *testing.T) {
+	const n = 3
+	cliConn, servConn := tcpPair(t)
+	s := NewServer(WithMessageBufferSize(n))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	//nobody drains mCh, all the messages are echoed anyway
+	r := bufio.NewReader(cliConn)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(cliConn, "%s %d\n", message, i)
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.mCh) != n {
+		t.Fatalf("Expected %d buffered messages but received %d", n, len(s.mCh))
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+//flakyListener fails the first fails calls to Accept with a temporary error
+type flakyListener struct {
+	net.Listener
+	fails int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.fails > 0 {
+		l.fails--
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+//closeCountingListener counts how many times its connections are closed
+type closeCountingListener struct {
+	net.Listener
+	closes atomic.Int32
+}
+
+func (l *closeCountingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &closeCountingConn{Conn: conn, closes: &l.closes}, nil
+}
+
+type closeCountingConn struct {
+	net.Conn
+	closes *atomic.Int32
+}
+
+func (c *closeCountingConn) Close() error {
+	c.closes.Add(1)
+	return c.Conn.Close()
+}
+
+//This test shows Serve closes every connection exactly once, after the handler returns,
+//whether the client closes it or the server is stopped.
+func TestServeClosesOnce(t *testing.T) {
+	for _, clientCloses := range []bool{true, false} {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counting := &closeCountingListener{Listener: l}
+		s := NewServer(WithPersister(&recordingPersister{}))
+		ctx, cancel := context.WithCancel(context.Background())
+		finished := make(chan struct{})
+		go func() {
+			s.Serve(counting, ctx)
+			close(finished)
+		}()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(message + "\n"))
+		mustReadLine(t, bufio.NewReader(conn))
+		if clientCloses {
+			conn.Close()
+			if err := s.WaitForConnections(context.Background(), 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cancel()
+		l.Close()
+		<-finished
+		conn.Close()
+		if n := counting.closes.Load(); n != 1 {
+			t.Fatalf("Expected the connection to be closed once but it was closed %d times", n)
+		}
+	}
+}
+
+//This test shows Serve keeps accepting connections after temporary accept errors.
+func TestServeTemporaryError(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(WithPersister(&recordingPersister{}))
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(&flakyListener{Listener: l, fails: 3}, context.Background())
+		close(finished)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(message + "\n"))
+	if echo, err := bufio.NewReader(conn).ReadString('\n'); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s' (%v)", message, echo, err)
+	}
+	conn.Close()
+	l.Close()
+	<-finished
+}
+
+//burstyListener fails bursts of calls to Accept with a temporary error, accepting a connection after every burst
+type burstyListener struct {
+	net.Listener
+	bursts []int
+}
+
+func (l *burstyListener) Accept() (net.Conn, error) {
+	if len(l.bursts) > 0 && l.bursts[0] > 0 {
+		l.bursts[0]--
+		return nil, temporaryError{}
+	}
+	if len(l.bursts) > 0 {
+		l.bursts = l.bursts[1:]
+	}
+	return l.Listener.Accept()
+}
+
+//This test shows the delay between temporary accept errors grows up to the maximum backoff
+//and starts over once a connection is accepted.
+func TestServeAcceptBackoff(t *testing.T) {
+	const maxBackoff = 40 * time.Millisecond
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs syncBuffer
+	s := NewServer(WithPersister(&recordingPersister{}), WithMaxAcceptBackoff(maxBackoff), WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(&burstyListener{Listener: l, bursts: []int{5, 2}}, context.Background())
+		close(finished)
+	}()
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(message + "\n"))
+		mustReadLine(t, bufio.NewReader(conn))
+		conn.Close()
+	}
+	l.Close()
+	<-finished
+
+	var delays []time.Duration
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if !strings.Contains(line, "Accept failed, retrying") {
+			continue
+		}
+		_, v, _ := strings.Cut(line, "delay=")
+		d, err := time.ParseDuration(strings.Fields(v)[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		delays = append(delays, d)
+	}
+	if len(delays) != 7 {
+		t.Fatalf("Expected 7 retries but received %d: %v", len(delays), delays)
+	}
+	for i, d := range delays {
+		if d > maxBackoff {
+			t.Fatalf("Expected the delays to be capped to %v but received %v", maxBackoff, delays)
+		}
+		//the delay doubles with every error until it's capped, the jitter can't undo that
+		if i > 0 && i < 4 && d < delays[i-1] {
+			t.Fatalf("Expected the delays to grow but received %v", delays)
+		}
+	}
+	if delays[5] > minAcceptBackoff {
+		t.Fatalf("Expected the delay to start over after a connection was accepted but received %v", delays)
+	}
+}
+
+//nilConnListener returns a nil connection without an error from its first call to Accept
+type nilConnListener struct {
+	net.Listener
+	once sync.Once
+}
+
+func (l *nilConnListener) Accept() (net.Conn, error) {
+	var returned bool
+	l.once.Do(func() { returned = true })
+	if returned {
+		return nil, nil
+	}
+	return l.Listener.Accept()
+}
+
+//This test shows Serve skips a nil connection from Accept and serves the next one.
+func TestServeNilConn(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(WithPersister(&recordingPersister{}))
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(&nilConnListener{Listener: l}, context.Background())
+		close(finished)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(message + "\n"))
+	if line := mustReadLine(t, bufio.NewReader(conn)); line != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s'", message, line)
+	}
+	conn.Close()
+	l.Close()
+	<-finished
+}
+
+//This test shows Serve returns the accept error when someone else closes the listener.
+func TestServeClosedListener(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- NewServer().Serve(l, context.Background())
+	}()
+	l.Close()
+	if err := <-serveErr; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Expected '%v' but received '%v'", net.ErrClosed, err)
+	}
+}
+
+//This test shows the ready callback receives the address the server listens on.
+func TestServerOnReady(t *testing.T) {
+	addrCh := make(chan net.Addr, 1)
+	s := NewServer(WithAddr(addr), WithOnReady(func(addr net.Addr) {
+		addrCh <- addr
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(finished)
+	}()
+	<-s.Ready()
+
+	select {
+	case got := <-addrCh:
+		if tcpAddr, ok := got.(*net.TCPAddr); !ok || tcpAddr.Port == 0 || got.String() != s.Addr().String() {
+			t.Fatalf("Expected '%v' but received '%v'", s.Addr(), got)
+		}
+	default:
+		t.Fatal("Expected the callback to be called before the server is ready")
+	}
+	cancel()
+	<-finished
+}
+
+//This test shows a server with several addresses echoes on all of them.
+func TestServerListenAddr(t *testing.T) {
+	s := NewServer(WithAddr(addr), WithListenAddr(addr))
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(finished)
+	}()
+	<-s.Ready()
+
+	addrs := s.Addrs()
+	if len(addrs) != 2 || addrs[0].String() == addrs[1].String() {
+		t.Fatalf("Expected two different addresses but received %v", addrs)
+	}
+	for _, a := range addrs {
+		conn, err := net.Dial("tcp", a.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(message + "\n"))
+		if echo, err := bufio.NewReader(conn).ReadString('\n'); echo != message+"\n" {
+			t.Fatalf("Expected '%s' on %v but received '%s' (%v)", message, a, echo, err)
+		}
+		conn.Close()
+	}
+	cancel()
+	<-finished
+	for _, a := range addrs {
+		if c, err := net.Dial("tcp", a.String()); err == nil {
+			c.Close()
+			t.Fatalf("Expected %v to be closed", a)
+		}
+	}
+}
+
+//This test shows in persist only mode the messages are persisted but not echoed.
+func TestPersistAndEchoNoEcho(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte)
+	s := NewServer(WithMessageChannel(mCh), WithEcho(false))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	cliConn.Write([]byte(message + "\n"))
+	if m := <-mCh; string(m) != message {
+		t.Fatalf("Expected '%s' but received '%s'", message, m)
+	}
+	cliConn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := cliConn.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("Expected no echo but received %d bytes (%v)", n, err)
+	}
+
+	//datagrams aren't echoed either
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go s.ServePacket(pc, ctx)
+	udpConn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	udpConn.Write([]byte(message))
+	if m := <-mCh; string(m) != message {
+		t.Fatalf("Expected '%s' but received '%s'", message, m)
+	}
+	udpConn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := udpConn.Read(make([]byte, maxDatagramSize)); !isTimeout(err) {
+		t.Fatalf("Expected no echo but received %d bytes (%v)", n, err)
+	}
+}
+
+//This test shows in persist only mode the persisted bytes are counted but nothing is echoed.
+func TestPersistAndEchoByteCounters(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	p := &recordingPersister{}
+	s := NewServer(WithPersister(p), WithEcho(false))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.handleConn(servConn, context.Background())
+	}()
+
+	for i := 0; i < 3; i++ {
+		cliConn.Write([]byte(message + "\n"))
+	}
+	cliConn.(*net.TCPConn).CloseWrite()
+	if err := <-errCh; err != nil {
+		t.Fatalf("Expected no error but received '%v'", err)
+	}
+	if n := s.PersistedBytes(); n != uint64(3*len(message)) {
+		t.Fatalf("Expected %d persisted bytes but received %d", 3*len(message), n)
+	}
+	if n := s.EchoedBytes(); n != 0 {
+		t.Fatalf("Expected no echoed bytes but received %d", n)
+	}
+}
+
+//This test shows a handler waiting for a stuck consumer returns once its context is cancelled.
+func TestPersistAndEchoStuckConsumer(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte) //nobody drains it
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- PersistAndEcho(mCh, servConn, ctx)
+	}()
+
+	cliConn.Write([]byte(message + "\n"))
+	//give the handler time to block on mCh
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Expected no error but received '%v'", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the handler to return once the context is cancelled")
+	}
+}
+
+//This test shows Serve with an accept timeout stops once its context is cancelled
+//without closing the listener.
+func TestServeAcceptTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s := NewServer(WithAcceptTimeout(10 * time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Serve(l, ctx)
+	}()
+	time.Sleep(30 * time.Millisecond) //a few timeouts go by
+	cancel()
+	select {
+	case err := <-serveErr:
+		if err != context.Canceled {
+			t.Fatalf("Expected '%v' but received '%v'", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Serve to stop once the context is cancelled")
+	}
+}
+
+//This test shows clients read the banner before the echo of their first message, and it isn't persisted.
+func TestPersistAndEchoBanner(t *testing.T) {
+	const banner = "220 echo ready\r\n"
+	p := &recordingPersister{}
+	addr, stop := StartTest(t, WithPersister(p), WithBanner([]byte(banner)))
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	//nothing was sent yet
+	if line := mustReadLine(t, r); line != banner {
+		t.Fatalf("Expected the banner '%s' but received '%s'", banner, line)
+	}
+	conn.Write([]byte(message + "\n"))
+	if line := mustReadLine(t, r); line != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s'", message, line)
+	}
+	if msgs := p.messages(); len(msgs) != 1 || msgs[0] != message {
+		t.Fatalf("Expected only ['%s'] to be persisted but received %v", message, msgs)
+	}
+}
+
+//This test shows the quit command closes the connection after the farewell, without being persisted.
+func TestPersistAndEchoQuit(t *testing.T) {
+	for _, tc := range []struct {
+		opts     []Option
+		quit     string
+		response string
+	}{
+		{nil, "QUIT", message + "\n"},
+		{[]Option{WithQuitCommand([]byte("bye"), []byte("see ya"))}, "bye", message + "\nsee ya\n"},
+	} {
+		cliConn, servConn := tcpPair(t)
+		p := &recordingPersister{}
+		s := NewServer(append(tc.opts, WithPersister(p))...)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s.handleConn(servConn, context.Background())
+		}()
+
+		cliConn.Write([]byte(message + "\n" + tc.quit + "\n"))
+		cliConn.SetReadDeadline(time.Now().Add(time.Second))
+		resp, err := io.ReadAll(cliConn)
+		if err != nil {
+			t.Fatalf("Expected the connection to be closed but received %v", err)
+		}
+		if string(resp) != tc.response {
+			t.Fatalf("Expected '%s' but received '%s'", tc.response, resp)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("Expected no error but received '%v'", err)
+		}
+		if msgs := p.messages(); len(msgs) != 1 || msgs[0] != message {
+			t.Fatalf("Expected only ['%s'] to be persisted but received %v", message, msgs)
+		}
+		cliConn.Close()
+	}
+}
+
+//This test shows health checks are answered but not persisted, unless the responder is disabled.
+func TestPersistAndEchoPing(t *testing.T) {
+	for _, tc := range []struct {
+		opts     []Option
+		request  string
+		response string
+	}{
+		{nil, "PING", "PONG"},
+		{[]Option{WithPingResponder([]byte("ruok"), []byte("imok"))}, "ruok", "imok"},
+	} {
+		cliConn, servConn := tcpPair(t)
+		mCh := make(chan []byte, 1)
+		s := NewServer(append(tc.opts, WithMessageChannel(mCh))...)
+		ctx, cancel := context.WithCancel(context.Background())
+		go s.persistAndEcho(servConn, ctx)
+
+		cliConn.Write([]byte(tc.request + "\n"))
+		if resp, err := bufio.NewReader(cliConn).ReadString('\n'); resp != tc.response+"\n" {
+			t.Fatalf("Expected '%s' but received '%s' (%v)", tc.response, resp, err)
+		}
+		if len(mCh) != 0 {
+			t.Fatalf("Expected the health check not to be persisted but received '%s'", <-mCh)
+		}
+		cancel()
+	}
+
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte, 1)
+	s := NewServer(WithMessageChannel(mCh), WithPingResponder(nil, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+	cliConn.Write([]byte("PING\n"))
+	if echo, err := bufio.NewReader(cliConn).ReadString('\n'); echo != "PING\n" {
+		t.Fatalf("Expected 'PING' to be echoed but received '%s' (%v)", echo, err)
+	}
+	if m := <-mCh; string(m) != "PING" {
+		t.Fatalf("Expected 'PING' to be persisted but received '%s'", m)
+	}
+}
+
+//This test shows a connection is closed once it reaches the connection timeout, even if it's active.
+func TestServeConnectionTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(WithConnectionTimeout(100*time.Millisecond), WithPersister(&recordingPersister{}))
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, context.Background())
+		close(finished)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	r := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err := conn.Write([]byte(message + "\n")); err != nil {
+			break
+		}
+		if _, err := r.ReadString('\n'); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond) //stay active
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Expected the connection to be closed after 100ms but it was closed after %v", elapsed)
+	}
+	l.Close()
+	<-finished
+}
+
+//This test shows ListenAndServe returns nil after a clean shutdown
+//and the error when the server can't listen.
+func TestListenAndServe(t *testing.T) {
+	s := NewServer(WithAddr(addr))
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.ListenAndServe(ctx)
+	}()
+	<-s.Ready()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(message + "\n"))
+	if echo, err := bufio.NewReader(conn).ReadString('\n'); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s' (%v)", message, echo, err)
+	}
+	conn.Close()
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatalf("Expected no error after a clean shutdown but received '%v'", err)
+	}
+
+	if err := NewServer(WithAddr("invalid address")).ListenAndServe(context.Background()); err == nil {
+		t.Fatal("Expected an error for an invalid address")
+	}
+}
+
+//This test shows the message consumer receives the messages in order.
+func TestServerMessageConsumer(t *testing.T) {
+	const n = 20
+	var msgs []string //only touched by the consumer until Run returns
+	s := NewServer(WithAddr(addr), WithMessageConsumer(func(msg []byte) {
+		msgs = append(msgs, string(msg))
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(finished)
+	}()
+	<-s.Ready()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(conn, "%s %d\n", message, i)
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+	cancel()
+	<-finished
+
+	if len(msgs) != n {
+		t.Fatalf("Expected %d messages but received %v", n, msgs)
+	}
+	for i, m := range msgs {
+		if expected := fmt.Sprintf("%s %d", message, i); m != expected {
+			t.Fatalf("Expected '%s' but received '%s'", expected, m)
+		}
+	}
+}
+
+//This test shows a client sending a message over the maximum size is told why it's disconnected.
+func TestPersistAndEchoMaxMessageSize(t *testing.T) {
+	const max = 16
+	for _, tc := range []struct {
+		opts     []Option
+		response string
+	}{
+		{[]Option{WithMaxMessageSize(max)}, "ERR message too large\n"},
+		{[]Option{WithTooLargeResponse([]byte("-ERR too long")), WithMaxMessageSize(max), WithLineTerminator([]byte("\r\n"))}, "-ERR too long\r\n"},
+	} {
+		cliConn, servConn := tcpPair(t)
+		mCh := make(chan []byte, 1)
+		s := NewServer(append(tc.opts, WithMessageChannel(mCh))...)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s.handleConn(servConn, context.Background())
+		}()
+
+		//just enough to fill the buffer (with room for the terminator), so the server reads all of it
+		cliConn.Write([]byte(strings.Repeat("a", max+2)))
+		resp, err := io.ReadAll(cliConn)
+		if string(resp) != tc.response {
+			t.Fatalf("Expected '%s' but received '%s' (%v)", tc.response, resp, err)
+		}
+		if err := <-errCh; err != bufio.ErrTooLong {
+			t.Fatalf("Expected '%v' but received '%v'", bufio.ErrTooLong, err)
+		}
+		if len(mCh) != 0 {
+			t.Fatalf("Expected the message not to be persisted but received '%s'", <-mCh)
+		}
+	}
+}
+
+//This test shows stopping Run while clients keep sending never sends on the closed mCh.
+//It is meant to be run with -race
+func TestRunStress(t *testing.T) {
+	iterations := 10
+	if testing.Short() {
+		iterations = 3
+	}
+	for i := 0; i < iterations; i++ {
+		s := NewServer(WithAddr(addr), WithMessageConsumer(func(msg []byte) {}))
+		ctx, cancel := context.WithCancel(context.Background())
+		finished := make(chan struct{})
+		go func() {
+			s.Run(ctx)
+			close(finished)
+		}()
+		<-s.Ready()
+
+		var wg sync.WaitGroup
+		for c := 0; c < 5; c++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := net.Dial("tcp", s.Addr().String())
+				if err != nil {
+					return //the server may be gone already
+				}
+				defer conn.Close()
+				go io.Copy(io.Discard, conn)
+				for {
+					if _, err := conn.Write([]byte(message + "\n")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(5 * time.Millisecond)
+		cancel()
+		<-finished
+		wg.Wait()
+	}
+}
+
+//This test shows sequenced echoes are numbered per connection while the messages are persisted as they are.
+func TestPersistAndEchoSequenced(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	p := &recordingPersister{}
+	s := NewServer(WithPersister(p), WithSequencedEcho(true))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	r := bufio.NewReader(cliConn)
+	for i := 1; i <= 3; i++ {
+		cliConn.Write([]byte(message + "\n"))
+		if expected, echo := fmt.Sprintf("%d %s\n", i, message), mustReadLine(t, r); echo != expected {
+			t.Fatalf("Expected '%s' but received '%s'", expected, echo)
+		}
+	}
+	for _, m := range p.messages() {
+		if m != message {
+			t.Fatalf("Expected '%s' to be persisted but received '%s'", message, m)
+		}
+	}
+}
+
+//This test shows the echo transform changes the echo while mCh receives the original message.
+func TestPersistAndEchoTransform(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	mCh := make(chan []byte, 1)
+	s := NewServer(WithMessageChannel(mCh), WithEchoTransform(bytes.ToUpper))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	cliConn.Write([]byte(message + "\n"))
+	if expected, echo := strings.ToUpper(message)+"\n", mustReadLine(t, bufio.NewReader(cliConn)); echo != expected {
+		t.Fatalf("Expected '%s' but received '%s'", expected, echo)
+	}
+	if m := string(<-mCh); m != message {
+		t.Fatalf("Expected '%s' to be persisted but received '%s'", message, m)
+	}
+}
+
+func mustReadLine(t *testing.T, r *bufio.Reader) string {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+//This test shows only valid JSON messages are persisted and echoed with JSON validation.
+func TestPersistAndEchoJSONValidation(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	p := &recordingPersister{}
+	s := NewServer(WithPersister(p), WithJSONValidation(true))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.persistAndEcho(servConn, ctx)
+
+	r := bufio.NewReader(cliConn)
+	valid := `{"msg": "sup?"}`
+	for _, tc := range []struct{ line, response string }{
+		{valid, valid + "\n"},
+		{message, "ERR invalid json\n"},
+		{`{"msg": `, "ERR invalid json\n"},
+	} {
+		cliConn.Write([]byte(tc.line + "\n"))
+		if resp := mustReadLine(t, r); resp != tc.response {
+			t.Fatalf("Expected '%s' for '%s' but received '%s'", tc.response, tc.line, resp)
+		}
+	}
+	if msgs := p.messages(); len(msgs) != 1 || msgs[0] != valid {
+		t.Fatalf("Expected only ['%s'] to be persisted but received %v", valid, msgs)
+	}
+}
+
+//This test shows the message hook decides whether every message is persisted and echoed
+//and closes the connection when it rejects a message.
+func TestPersistAndEchoMessageHook(t *testing.T) {
+	cliConn, servConn := tcpPair(t)
+	p := &recordingPersister{}
+	errSpam := errors.New("spam")
+	s := NewServer(WithPersister(p), WithMessageHook(func(ctx context.Context, msg []byte) (bool, bool, error) {
+		switch string(msg) {
+		case "persist only":
+			return true, false, nil
+		case "echo only":
+			return false, true, nil
+		case "spam":
+			return false, false, errSpam
+		}
+		return true, true, nil
+	}))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.handleConn(servConn, context.Background())
+	}()
+
+	r := bufio.NewReader(cliConn)
+	cliConn.Write([]byte("persist only\necho only\n" + message + "\n"))
+	for _, want := range []string{"echo only\n", message + "\n"} {
+		if echo := mustReadLine(t, r); echo != want {
+			t.Fatalf("Expected '%s' but received '%s'", want, echo)
+		}
+	}
+	if msgs := p.messages(); len(msgs) != 2 || msgs[0] != "persist only" || msgs[1] != message {
+		t.Fatalf("Expected ['persist only' '%s'] to be persisted but received %v", message, msgs)
+	}
+
+	cliConn.Write([]byte("spam\n"))
+	if err := <-errCh; err != errSpam {
+		t.Fatalf("Expected '%v' but received '%v'", errSpam, err)
+	}
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed but received '%v'", err)
+	}
+	if msgs := p.messages(); len(msgs) != 2 {
+		t.Fatalf("Expected the rejected message not to be persisted but received %v", msgs)
+	}
+}
+
+//This test shows messages are trimmed before they're persisted and echoed.
+func TestPersistAndEchoTrimMessage(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		line string
+	}{
+		//the default terminator already drops the "\r"
+		{"carriage return", []Option{WithLineTerminator([]byte("\n")), WithTrimMessage("\r")}, "hi\r\n"},
+		{"whitespace", []Option{WithTrimMessage(" \t\r")}, "hi \t \r\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cliConn, servConn := tcpPair(t)
+			p := &recordingPersister{}
+			s := NewServer(append(tc.opts, WithPersister(p))...)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go s.persistAndEcho(servConn, ctx)
+
+			cliConn.Write([]byte(tc.line))
+			if echo := mustReadLine(t, bufio.NewReader(cliConn)); echo != "hi\n" {
+				t.Fatalf("Expected 'hi' but received %q", echo)
+			}
+			if msgs := p.messages(); len(msgs) != 1 || msgs[0] != "hi" {
+				t.Fatalf("Expected ['hi'] to be persisted but received %q", msgs)
+			}
+		})
+	}
+}
+
+//This test shows the last message of a connection is persisted without its delimiter
+//when the client closes the connection, and with WithPersistUnterminated when the connection is interrupted.
+func TestPersistAndEchoUnterminated(t *testing.T) {
+	for _, interrupt := range []bool{false, true} {
+		cliConn, servConn := tcpPair(t)
+		mCh := make(chan []byte, 1)
+		s := NewServer(WithMessageChannel(mCh), WithPersistUnterminated(true))
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s.persistAndEcho(servConn, ctx)
+		}()
+
+		const partial = "message with no delimiter"
+		cliConn.Write([]byte(message + "\n" + partial))
+		if m := <-mCh; string(m) != message {
+			t.Fatalf("Expected '%s' but received '%s'", message, m)
+		}
+		if interrupt {
+			//give the handler time to read the partial message
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		} else {
+			cliConn.(*net.TCPConn).CloseWrite()
+		}
+		select {
+		case m := <-mCh:
+			if string(m) != partial {
+				t.Fatalf("Expected '%s' but received '%s'", partial, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the unterminated message to be persisted (interrupted: %v)", interrupt)
+		}
+		<-errCh
+		cancel()
+	}
+}
+
+//This test shows that Stop closes the listener, interrupts the connections and waits for Run
+func TestStop(t *testing.T) {
+	s := NewServer(WithAddr("127.0.0.1:0"))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Run(context.Background())
+	}()
+	<-s.Ready()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintln(conn, message)
+	mustReadLine(t, r)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Stop to return")
+	}
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Expected a clean termination but received '%v'", err)
+		}
+	default:
+		t.Fatal("Expected Run to return before Stop")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed but received '%v'", err)
+	}
+	if _, err := net.Dial("tcp", s.Addr().String()); err == nil {
+		t.Fatal("Expected the listener to be closed")
+	}
+	if err := s.StopContext(context.Background()); err != nil {
+		t.Fatalf("Expected Stop to be safe to repeat but received '%v'", err)
+	}
+}
+
+//discardPersister persists nothing, so the benchmarks measure the handler
+type discardPersister struct{}
+
+func (discardPersister) Persist(ctx context.Context, msg []byte) error {
+	return nil
+}
+
+//This benchmark shows pooling the read buffers saves an allocation per connection
+//when clients connect, send one message and disconnect
+func BenchmarkPersistAndEchoChurn(b *testing.B) {
+	for _, pool := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pool=%v", pool), func(b *testing.B) {
+			s := NewServer(WithPersister(discardPersister{}), WithBufferPool(pool), WithLogger(slog.New(slog.DiscardHandler)))
+			ctx := context.Background()
+			msg := []byte(message + "\n")
+			echo := make([]byte, len(msg))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cliConn, servConn := net.Pipe()
+				done := make(chan struct{})
+				go func() {
+					s.persistAndEcho(servConn, ctx)
+					close(done)
+				}()
+				cliConn.Write(msg)
+				io.ReadFull(cliConn, echo)
+				cliConn.Close()
+				<-done
+			}
+		})
+	}
+}
+
+//This test shows concurrent connections don't share the pooled buffers, every message and echo stays intact
+func TestPersistAndEchoBufferPool(t *testing.T) {
+	p := &recordingPersister{}
+	s := NewServer(WithPersister(p))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const conns, msgs = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		cliConn, servConn := tcpPair(t)
+		go s.persistAndEcho(servConn, ctx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := bufio.NewReader(cliConn)
+			for j := 0; j < msgs; j++ {
+				msg := fmt.Sprintf("conn %d message %d", i, j)
+				fmt.Fprintln(cliConn, msg)
+				if echo, err := r.ReadString('\n'); echo != msg+"\n" {
+					t.Errorf("Expected %q but received %q (%v)", msg, echo, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(p.messages()); n != conns*msgs {
+		t.Fatalf("Expected %d messages but received %d", conns*msgs, n)
+	}
+}
+
+//This test shows Run gives up on a stuck handler after the shutdown timeout,
+//closing its connection and returning ErrShutdownTimeout
+func TestRunShutdownTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	stuck := make(chan struct{})
+	defer close(stuck)
+	s := NewServer(WithAddr(addr), WithShutdownTimeout(timeout), WithHandler(func(conn net.Conn, ctx context.Context) error {
+		<-stuck //ignores ctx
+		return nil
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Run(ctx)
+	}()
+	<-s.Ready()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := s.WaitForConnections(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != ErrShutdownTimeout {
+			t.Fatalf("Expected '%v' but received '%v'", ErrShutdownTimeout, err)
+		}
+		if elapsed := time.Since(start); elapsed < timeout {
+			t.Fatalf("Expected Run to wait for %v but it returned after %v", timeout, elapsed)
+		}
+	case <-time.After(5 * timeout):
+		t.Fatal("Expected Run to return after the shutdown timeout")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed but received '%v'", err)
+	}
+}
+
+//This test shows the shutdown timeout doesn't cut Shutdown's grace period short.
+func TestRunShutdownTimeoutGracePeriod(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	s := NewServer(WithAddr(addr), WithShutdownTimeout(timeout), WithPersister(&recordingPersister{}))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Run(context.Background())
+	}()
+	<-s.Ready()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//in the middle of a message
+	conn.Write([]byte(message[:1]))
+	if err := s.WaitForConnections(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*timeout)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(ctx)
+	}()
+	time.Sleep(4 * timeout)
+	conn.Write([]byte(message[1:] + "\n"))
+	if echo := mustReadLine(t, bufio.NewReader(conn)); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s'", message, echo)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Expected a graceful shutdown but received '%v'", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Expected Run to wait for the grace period but received '%v'", err)
+	}
+}
+
+//This test shows the server shuts down on its own after the run duration,
+//after consuming all the messages it received.
+func TestRunDuration(t *testing.T) {
+	const duration = 200 * time.Millisecond
+	var mu sync.Mutex
+	var consumed []string
+	s := NewServer(WithAddr(addr), WithRunDuration(duration), WithMessageConsumer(func(msg []byte) {
+		time.Sleep(time.Millisecond) //a slow consumer, there's still something to drain
+		mu.Lock()
+		defer mu.Unlock()
+		consumed = append(consumed, string(msg))
+	}))
+	start := time.Now()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Run(context.Background())
+	}()
+	<-s.Ready()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	const messages = 50
+	for i := 0; i < messages; i++ {
+		fmt.Fprintln(conn, message)
+		mustReadLine(t, r)
+	}
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Expected a clean termination but received '%v'", err)
+		}
+		if elapsed := time.Since(start); elapsed < duration {
+			t.Fatalf("Expected the server to run for %v but it stopped after %v", duration, elapsed)
+		}
+	case <-time.After(5 * duration):
+		t.Fatal("Expected the server to stop on its own")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(consumed) != messages {
+		t.Fatalf("Expected %d messages to be consumed but received %d", messages, len(consumed))
+	}
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//This test shows waitForShutdown cancels the context when a signal arrives.
+func TestWaitForShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//SIGWINCH is ignored by default, so it can't kill the test before we listen for it
+	go waitForShutdown(cancel, syscall.SIGWINCH)
+
+	for ctx.Err() == nil {
+		syscall.Kill(os.Getpid(), syscall.SIGWINCH)
+		select {
+		case <-ctx.Done():
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
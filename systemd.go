@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+//listenFDsStart is the first file descriptor systemd passes, after stdin, stdout and stderr
+const listenFDsStart = 3
+
+//ListenersFromSystemd returns the listeners systemd passed to the process with socket activation,
+//to be served with WithListener. It returns no listeners if the process wasn't socket activated
+//(or isn't running on Linux). The LISTEN_* environment variables are unset,
+//so child processes don't inherit them
+func ListenersFromSystemd() ([]net.Listener, error) {
+	if runtime.GOOS != "linux" {
+		return nil, nil
+	}
+	return listenersFromFDs(listenFDsStart)
+}
+
+//listenersFromFDs implements ListenersFromSystemd starting at the file descriptor first
+func listenersFromFDs(first int) ([]net.Listener, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		//meant for another process
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	fdNames := strings.Split(names, ":")
+	var ls []net.Listener
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(first+i)
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+		f := os.NewFile(uintptr(first+i), name)
+		//FileListener dups the descriptor, the original isn't needed anymore
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
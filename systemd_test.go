@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+//This test shows there are no listeners when the process wasn't socket activated.
+func TestListenersFromSystemdNotActivated(t *testing.T) {
+	for _, pid := range []string{"", strconv.Itoa(os.Getpid() + 1)} {
+		t.Setenv("LISTEN_PID", pid)
+		t.Setenv("LISTEN_FDS", "1")
+		ls, err := ListenersFromSystemd()
+		if err != nil || len(ls) != 0 {
+			t.Fatalf("Expected no listeners but received %v (%v)", ls, err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+//This test shows the listeners passed by systemd are turned into net.Listeners.
+func TestListenersFromFDs(t *testing.T) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	//a copy of the listener's descriptor stands in for the one systemd passes
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the descriptor is closed by listenersFromFDs, not by f
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+
+	ls, err := listenersFromFDs(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 1 || ls[0].Addr().String() != l.Addr().String() {
+		t.Fatalf("Expected a listener on '%v' but received %v", l.Addr(), ls)
+	}
+	ls[0].Close()
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("Expected the environment to be unset")
+	}
+}
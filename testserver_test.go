@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+//StartTest runs a server with opts on an OS assigned localhost port and returns its address,
+//so tests don't have to repeat the ready/ctx/finished dance.
+//stop cancels the server's context and waits for it to finish, it is also called when the test ends.
+//It lives in a _test.go file since package main can't be imported by other packages' tests
+func StartTest(t testing.TB, opts ...Option) (addr string, stop func()) {
+	t.Helper()
+	s := NewServer(append([]Option{WithAddr("127.0.0.1:0")}, opts...)...)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Run(ctx)
+	}()
+	select {
+	case <-s.Ready():
+	case err := <-errCh:
+		cancel()
+		t.Fatalf("Starting the server failed: %v", err)
+	}
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			if err := <-errCh; err != nil {
+				t.Errorf("The server failed: %v", err)
+			}
+		})
+	}
+	t.Cleanup(stop)
+	return s.Addr().String(), stop
+}
+
+//This test shows how to test against a server started with StartTest.
+func TestStartTest(t *testing.T) {
+	addr, stop := StartTest(t, WithSequencedEcho(true))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(message + "\n"))
+	if echo := mustReadLine(t, bufio.NewReader(conn)); echo != "1 "+message+"\n" {
+		t.Fatalf("Expected '1 %s' but received '%s'", message, echo)
+	}
+	conn.Close()
+
+	//stopping early is optional, the server is stopped when the test ends anyway
+	stop()
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatal("Expected the server to be stopped")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+//handshake completes the TLS handshake of conn, if it is a TLS connection.
+//Otherwise the handshake would only happen on the handler's first read
+func (s *Server) handshake(conn net.Conn, ctx context.Context) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	done := s.awaitHandshake(conn)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	done()
+	state := tlsConn.ConnectionState()
+	s.connLogger(ctx).Info("Negotiated TLS", "version", tls.VersionName(state.Version))
+	return nil
+}
+
+//peerCommonName returns the Common Name of the client certificate of conn,
+//if it is a TLS connection whose client sent one that was verified (see: tls.Config.ClientAuth).
+//The peer certificates are there even when they weren't verified, e.g. with tls.RequireAnyClientCert
+func peerCommonName(conn net.Conn) (string, bool) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", false
+	}
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", false
+	}
+	return chains[0][0].Subject.CommonName, true
+}
+
+//VirtualService is how the connections to one TLS server name are handled, see: WithVirtualServices
+type VirtualService struct {
+	//Persister persists the messages of the default handler instead of the server's persister, if set
+	Persister Persister
+	//Handler handles the connections instead of the server's handler, if set.
+	//It is wrapped with the server's middleware too
+	Handler Handler
+}
+
+//virtualServiceKey is the context key of the connection's VirtualService
+type virtualServiceKey struct{}
+
+//route looks up the virtual service of the server name the client of conn asked for (SNI),
+//if it is a TLS connection, and returns ctx with both
+func (s *Server) route(conn net.Conn, ctx context.Context) context.Context {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ctx
+	}
+	name := tlsConn.ConnectionState().ServerName
+	if name == "" {
+		//clients connecting by IP don't send one
+		return ctx
+	}
+	ctx = context.WithValue(ctx, serverNameKey{}, name)
+	if service, ok := s.services[name]; ok {
+		ctx = context.WithValue(ctx, virtualServiceKey{}, service)
+	}
+	return ctx
+}
+
+//persisterOf returns the Persister of the connection handled with ctx
+func (s *Server) persisterOf(ctx context.Context) Persister {
+	if service, ok := ctx.Value(virtualServiceKey{}).(VirtualService); ok && service.Persister != nil {
+		return service.Persister
+	}
+	return s.persister
+}
+
+//handlerOf returns the Handler of the connection handled with ctx
+func (s *Server) handlerOf(ctx context.Context) Handler {
+	if service, ok := ctx.Value(virtualServiceKey{}).(VirtualService); ok && service.Handler != nil {
+		return service.Handler
+	}
+	return s.handler
+}
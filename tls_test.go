@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+//selfSignedCert creates a certificate for localhost signed by itself
+func selfSignedCert(t *testing.T, commonName string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+//This test shows messages are echoed over TLS
+//and that cancelling the context still interrupts TLS connections.
+func TestServerTLS(t *testing.T) {
+	cert, pool := selfSignedCert(t, "localhost")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mCh := make(chan []byte)
+	s := NewServer(WithMessageChannel(mCh), WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	finished := make(chan struct{})
+	go func() {
+		s.Serve(l, ctx)
+		close(finished)
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(message + "\n"))
+	if m := <-mCh; string(m) != message {
+		t.Fatalf("Expected '%s' but received '%s'", message, m)
+	}
+	if echo, err := bufio.NewReader(conn).ReadString('\n'); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s' (%v)", message, echo, err)
+	}
+
+	l.Close()
+	cancel() //the handler is blocked reading from the TLS connection
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Expected cancelling the context to interrupt the TLS connection")
+	}
+}
+
+//This test shows the first byte timeout closes TLS connections that never start the handshake.
+func TestServerTLSFirstByteTimeout(t *testing.T) {
+	cert, _ := selfSignedCert(t, "localhost")
+	a, stop := StartTest(t, WithPersister(&recordingPersister{}), WithFirstByteTimeout(50*time.Millisecond),
+		WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	defer stop()
+
+	//no ClientHello
+	conn, err := net.Dial("tcp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed but received '%v'", err)
+	}
+}
+
+//This test shows the handler gets the Common Name of a verified client certificate
+//and that clients without a certificate are rejected.
+func TestServerMutualTLS(t *testing.T) {
+	cert, pool := selfSignedCert(t, "localhost")
+	clientCert, clientPool := selfSignedCert(t, "alice")
+	identities := make(chan string, 1)
+	a, _ := StartTest(t, WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+	}), WithHandler(NoError(func(conn net.Conn, ctx context.Context) {
+		id, ok := ClientIdentity(ctx)
+		if !ok {
+			id = "no identity"
+		}
+		identities <- id
+	})))
+
+	conn, err := tls.Dial("tcp", a, &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if id := <-identities; id != "alice" {
+		t.Fatalf("Expected the client to be 'alice' but received '%s'", id)
+	}
+
+	anonymous, err := tls.Dial("tcp", a, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anonymous.Close()
+	//with TLS 1.3 the client learns it was rejected on its first read
+	anonymous.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := anonymous.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("Expected the handshake to fail but received '%v'", err)
+	}
+	select {
+	case id := <-identities:
+		t.Fatalf("Expected the client to be rejected but it was handled as '%s'", id)
+	default:
+	}
+}
+
+//This test shows a client certificate that wasn't verified isn't an identity, whatever its Common Name.
+func TestClientIdentityUnverified(t *testing.T) {
+	cert, pool := selfSignedCert(t, "localhost")
+	forged, _ := selfSignedCert(t, "admin")
+	identities := make(chan string, 1)
+	a, stop := StartTest(t, WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}), WithHandler(NoError(func(conn net.Conn, ctx context.Context) {
+		id, ok := ClientIdentity(ctx)
+		if !ok {
+			id = "no identity"
+		}
+		identities <- id
+	})))
+	defer stop()
+
+	conn, err := tls.Dial("tcp", a, &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{forged}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if id := <-identities; id != "no identity" {
+		t.Fatalf("Expected no identity but received '%s'", id)
+	}
+}
+
+//This test shows there's no identity without a client certificate.
+func TestClientIdentityMissing(t *testing.T) {
+	if _, ok := ClientIdentity(context.Background()); ok {
+		t.Fatal("Expected no identity")
+	}
+}
+
+//This test shows the connections to every TLS server name are handled by its own virtual service,
+//and the connections without one by the server.
+func TestVirtualServices(t *testing.T) {
+	cert, pool := selfSignedCert(t, "localhost")
+	alpha, beta, other := &recordingPersister{}, &recordingPersister{}, &recordingPersister{}
+	a, stop := StartTest(t, WithPersister(other), WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		WithVirtualServices(map[string]VirtualService{
+			"alpha.test": {Persister: alpha},
+			"beta.test":  {Persister: beta},
+			"gamma.test": {Handler: func(conn net.Conn, ctx context.Context) error {
+				//answers with the name it was selected by, instead of echoing
+				name, _ := ServerName(ctx)
+				_, err := conn.Write([]byte("hello from " + name + "\n"))
+				return err
+			}},
+		}))
+	defer stop()
+
+	for _, tc := range []struct{ name, response string }{
+		{"alpha.test", "alpha.test\n"},
+		{"beta.test", "beta.test\n"},
+		{"gamma.test", "hello from gamma.test\n"},
+		{"", "\n"},
+	} {
+		//the certificate is for localhost only
+		config := &tls.Config{RootCAs: pool, ServerName: tc.name, InsecureSkipVerify: tc.name != ""}
+		conn, err := tls.Dial("tcp", a, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(tc.name + "\n"))
+		if resp := mustReadLine(t, bufio.NewReader(conn)); resp != tc.response {
+			t.Fatalf("Expected '%s' for '%s' but received '%s'", tc.response, tc.name, resp)
+		}
+		conn.Close()
+	}
+	for want, p := range map[string]*recordingPersister{"alpha.test": alpha, "beta.test": beta, "": other} {
+		if msgs := p.messages(); len(msgs) != 1 || msgs[0] != want {
+			t.Fatalf("Expected ['%s'] to be persisted but received %v", want, msgs)
+		}
+	}
+}
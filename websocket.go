@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//webSocketGUID is appended to the client's key to accept the handshake (RFC 6455)
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+//the WebSocket opcodes we care about
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+)
+
+//maxWebSocketHeader is the largest header of a client frame: 2 bytes, an 8 byte length and a 4 byte mask
+const maxWebSocketHeader = 14
+
+var (
+	//ErrNotWebSocket is returned for HTTP requests that aren't a WebSocket handshake
+	ErrNotWebSocket = errors.New("not a websocket handshake")
+	//errUnmaskedFrame is a client frame without a mask, which clients must always send
+	errUnmaskedFrame = errors.New("unmasked websocket frame")
+)
+
+//framerKey is the context key of the connection's Framer, if it isn't the server's
+type framerKey struct{}
+
+//framerOf returns the Framer of the connection handled with ctx
+func (s *Server) framerOf(ctx context.Context) Framer {
+	if f, ok := ctx.Value(framerKey{}).(Framer); ok {
+		return f
+	}
+	return s.framer
+}
+
+//webSocketFramer frames messages as WebSocket text (or binary) messages, see: WithWebSocket.
+//Pings and pongs are ignored and a close frame ends the connection
+type webSocketFramer struct{}
+
+func (webSocketFramer) Split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	//a message may be fragmented into several frames
+	var msg []byte
+	for {
+		fin, op, payload, n, err := parseWebSocketFrame(data[advance:])
+		if err != nil {
+			return 0, nil, err
+		}
+		if n == 0 {
+			if atEOF && len(data) > advance {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			if msg != nil {
+				//wait for the rest of the message
+				return 0, nil, nil
+			}
+			return advance, nil, nil
+		}
+		advance += n
+		switch {
+		case op == wsClose:
+			return advance, nil, bufio.ErrFinalToken
+		case op&0x8 != 0:
+			//control frames may show up between the fragments
+			continue
+		}
+		msg = append(msg, payload...)
+		if fin {
+			if msg == nil {
+				msg = []byte{}
+			}
+			return advance, msg, nil
+		}
+	}
+}
+
+//parseWebSocketFrame parses the client frame at the start of data and unmasks its payload.
+//It returns n == 0 if the frame isn't complete yet
+func parseWebSocketFrame(data []byte) (fin bool, op byte, payload []byte, n int, err error) {
+	if len(data) < 2 {
+		return false, 0, nil, 0, nil
+	}
+	fin, op = data[0]&0x80 != 0, data[0]&0x0f
+	if data[1]&0x80 == 0 {
+		return false, 0, nil, 0, errUnmaskedFrame
+	}
+	length, header := uint64(data[1]&0x7f), 2
+	switch length {
+	case 126:
+		if len(data) < 4 {
+			return false, 0, nil, 0, nil
+		}
+		length, header = uint64(binary.BigEndian.Uint16(data[2:])), 4
+	case 127:
+		if len(data) < 10 {
+			return false, 0, nil, 0, nil
+		}
+		length, header = binary.BigEndian.Uint64(data[2:]), 10
+	}
+	if length > math.MaxInt32 {
+		return false, 0, nil, 0, bufio.ErrTooLong
+	}
+	header += 4
+	if len(data) < header || uint64(len(data)-header) < length {
+		return false, 0, nil, 0, nil
+	}
+	//the scanner's buffer may be parsed again, unmask a copy
+	mask := data[header-4 : header]
+	payload = make([]byte, length)
+	for i := range payload {
+		payload[i] = data[header+i] ^ mask[i%4]
+	}
+	return fin, op, payload, header + int(length), nil
+}
+
+//WriteFrame writes msg as a single unmasked text frame
+func (webSocketFramer) WriteFrame(w io.Writer, msg []byte) error {
+	header := []byte{0x80 | wsText, 0}
+	switch {
+	case len(msg) < 126:
+		header[1] = byte(len(msg))
+	case len(msg) <= math.MaxUint16:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(msg)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(msg)))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+//peekedConn reads through the reader that peeked at the first bytes of the connection
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+//Unwrap returns the accepted connection, e.g. to get to the *net.TCPConn
+func (c *peekedConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+//upgradeWebSocket answers conn's WebSocket handshake if that's how the client starts (see: WithWebSocket).
+//It returns the connection to handle, which reads the bytes it peeked at, and whether it's a WebSocket.
+//Cancelling ctx interrupts the handshake, and so does the first byte timeout (see: awaitHandshake).
+//A client that never sends anything isn't a WebSocket, the handler gets the timeout when it reads
+func (s *Server) upgradeWebSocket(conn net.Conn, ctx context.Context) (net.Conn, bool, error) {
+	stop := context.AfterFunc(ctx, func() {
+		interruptRead(conn)
+	})
+	done := s.awaitHandshake(conn)
+	r := bufio.NewReader(conn)
+	ws := looksLikeHTTP(r)
+	var err error
+	if ws {
+		err = acceptWebSocket(conn, r)
+	}
+	if !stop() {
+		err = ctx.Err()
+	} else {
+		done()
+	}
+	return &peekedConn{Conn: conn, r: r}, ws, err
+}
+
+//looksLikeHTTP reports whether the client starts with a GET request.
+//It only waits for another byte as long as everything it got so far matches
+func looksLikeHTTP(r *bufio.Reader) bool {
+	const get = "GET "
+	for n := 1; n <= len(get); n++ {
+		b, err := r.Peek(n)
+		if err != nil || !strings.HasPrefix(get, string(b)) {
+			//the handler gets the error, if any, when it reads
+			return false
+		}
+	}
+	return true
+}
+
+//acceptWebSocket reads the handshake request from r and accepts it
+func acceptWebSocket(conn net.Conn, r *bufio.Reader) error {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return err
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || key == "" {
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return ErrNotWebSocket
+	}
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	var resp bytes.Buffer
+	resp.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	resp.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	_, err = conn.Write(resp.Bytes())
+	return err
+}
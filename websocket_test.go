@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//dialWebSocket connects to addr and completes the WebSocket handshake
+func dialWebSocket(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	io.WriteString(conn, "GET /chat HTTP/1.1\r\nHost: "+addr+"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: "+key+"\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the accept value of the key from RFC 6455
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Expected the handshake to be accepted but received %v %v", resp.Status, resp.Header)
+	}
+	return conn, r
+}
+
+//writeWebSocketFrame writes a masked client frame
+func writeWebSocketFrame(t *testing.T, w io.Writer, fin bool, op byte, payload []byte) {
+	t.Helper()
+	b0 := op
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0, 0x80}
+	switch {
+	case len(payload) < 126:
+		frame[1] |= byte(len(payload))
+	default:
+		frame[1] |= 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := w.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//readWebSocketFrame reads an unmasked server frame
+func readWebSocketFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		ext := make([]byte, 2)
+		io.ReadFull(r, ext)
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0], payload
+}
+
+//This test shows WebSocket clients and line clients share the same port,
+//and that WebSocket messages (even fragmented ones) are persisted and echoed as text frames.
+func TestWebSocket(t *testing.T) {
+	p := &recordingPersister{}
+	a, _ := StartTest(t, WithWebSocket(true), WithPersister(p))
+
+	conn, r := dialWebSocket(t, a)
+	long := strings.Repeat(message, 100)
+	writeWebSocketFrame(t, conn, true, wsText, []byte(message))
+	writeWebSocketFrame(t, conn, false, wsText, []byte(long[:200]))
+	//a ping between the fragments is ignored
+	writeWebSocketFrame(t, conn, true, 0x9, nil)
+	writeWebSocketFrame(t, conn, true, 0x0, []byte(long[200:]))
+	for _, want := range []string{message, long} {
+		if b0, payload := readWebSocketFrame(t, r); b0 != 0x81 || string(payload) != want {
+			t.Fatalf("Expected a text frame with '%s' but received %#x '%s'", want, b0, payload)
+		}
+	}
+
+	line, err := net.Dial("tcp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer line.Close()
+	line.Write([]byte(message + "\n"))
+	if echo := mustReadLine(t, bufio.NewReader(line)); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s'", message, echo)
+	}
+
+	//a close frame closes the connection
+	writeWebSocketFrame(t, conn, true, wsClose, nil)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed but received '%v'", err)
+	}
+	want := []string{message, long, message}
+	deadline := time.Now().Add(time.Second)
+	for len(p.messages()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := p.messages(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v to be persisted but received %v", want, got)
+	}
+}
+
+//This test shows an HTTP request that isn't a WebSocket handshake is refused.
+func TestWebSocketNotUpgrade(t *testing.T) {
+	a, _ := StartTest(t, WithWebSocket(true), WithPersister(&recordingPersister{}))
+	conn, err := net.Dial("tcp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+a+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected %d but received %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+//This test shows the first byte timeout still closes connections that never send anything with WebSockets enabled.
+func TestWebSocketFirstByteTimeout(t *testing.T) {
+	a, stop := StartTest(t, WithWebSocket(true), WithFirstByteTimeout(50*time.Millisecond), WithPersister(&recordingPersister{}))
+	defer stop()
+	conn, err := net.Dial("tcp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed but received '%v'", err)
+	}
+
+	//the first byte clears the deadline, as without WebSockets
+	conn, err = net.Dial("tcp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte(message[:1]))
+	time.Sleep(100 * time.Millisecond)
+	conn.Write([]byte(message[1:] + "\n"))
+	if echo, err := r.ReadString('\n'); echo != message+"\n" {
+		t.Fatalf("Expected '%s' but received '%s' (%v)", message, echo, err)
+	}
+}